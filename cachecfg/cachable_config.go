@@ -15,6 +15,12 @@ var ErrCacheMiss = errors.New("cache miss")
 // UseDefaultValue is a custom error to indicate that DefaultValue should be used
 var UseDefaultValue = errors.New("use default value")
 
+// IsOutdatedValue reports whether err only means the returned value is stale.
+// AsyncGetValue and GetValueNoWait return it together with a usable old value.
+func IsOutdatedValue(err error) bool {
+	return errors.Is(err, errUseOutdatedValue)
+}
+
 // ValueFetcher defines the interface for fetching values
 type ValueFetcher[T any] interface {
 	// Key generates a key for the cache
@@ -48,6 +54,9 @@ type Config[T any] struct {
 	stopChan      chan struct{}
 	cleanInterval time.Duration
 
+	// RefreshPool bounds the async refreshes, nil means one goroutine per stale key
+	RefreshPool *RefreshPool
+
 	// tracks keys that have an in-flight async refresh to prevent duplicate goroutines
 	updatingMu sync.Mutex
 	updating   map[string]bool
@@ -170,6 +179,8 @@ func (c *Config[T]) GetValueNoWait(args ...any) (T, error) {
 // given key. If a refresh is already in flight for that key, it is a no-op.
 // Unlike GetValue, a failed fetch will never delete the stale cache entry, so
 // subsequent AsyncGetValue calls can still return the old value immediately.
+// When RefreshPool is set the refresh is queued to the pool instead, and a
+// dropped refresh is simply retried by the next stale read.
 func (c *Config[T]) triggerAsyncUpdate(key string, args ...any) {
 	c.updatingMu.Lock()
 	if c.updating[key] {
@@ -179,30 +190,41 @@ func (c *Config[T]) triggerAsyncUpdate(key string, args ...any) {
 	c.updating[key] = true
 	c.updatingMu.Unlock()
 
-	go func() {
-		defer func() {
-			c.updatingMu.Lock()
-			delete(c.updating, key)
-			c.updatingMu.Unlock()
-		}()
-
-		value, err := c.FetchValue(args...)
-		if err != nil && errors.Is(err, UseDefaultValue) {
-			if defaultValueFetcher, ok := c.ValueFetcher.(DefaultValueFetcher[T]); ok {
-				value, err = defaultValueFetcher.DefaultValue(args...)
-			}
-		}
-		if err != nil {
-			return
-		}
+	if c.RefreshPool == nil {
+		go c.asyncUpdate(key, args...)
+		return
+	}
+	if !c.RefreshPool.Submit(func() { c.asyncUpdate(key, args...) }) {
+		c.updatingMu.Lock()
+		delete(c.updating, key)
+		c.updatingMu.Unlock()
+	}
+}
 
-		c.Mutex.Lock()
-		c.Cache[key] = &singleCache[T]{
-			Value:      value,
-			ExpireTime: time.Now().Add(c.TTL),
-		}
-		c.Mutex.Unlock()
+// asyncUpdate fetches the value for key and stores it, clearing the in-flight mark when done
+func (c *Config[T]) asyncUpdate(key string, args ...any) {
+	defer func() {
+		c.updatingMu.Lock()
+		delete(c.updating, key)
+		c.updatingMu.Unlock()
 	}()
+
+	value, err := c.FetchValue(args...)
+	if err != nil && errors.Is(err, UseDefaultValue) {
+		if defaultValueFetcher, ok := c.ValueFetcher.(DefaultValueFetcher[T]); ok {
+			value, err = defaultValueFetcher.DefaultValue(args...)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	c.Mutex.Lock()
+	c.Cache[key] = &singleCache[T]{
+		Value:      value,
+		ExpireTime: time.Now().Add(c.TTL),
+	}
+	c.Mutex.Unlock()
 }
 
 // startCleaner starts a goroutine that periodically cleans up expired cache entries
@@ -0,0 +1,61 @@
+package cachecfg
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DetachTimeout is the timeout used with Detach by the readers of this module
+const DetachTimeout = 5 * time.Second
+
+// Detach returns a context that keeps the values of ctx but not its cancellation or deadline,
+// it is done timeout after Detach is called instead (never when timeout <= 0).
+//
+// Pass it to AsyncGetValue and GetValueNoWait: the background refresh captures the args and
+// outlives the caller, with a request ctx every refresh fails once the request has finished and
+// the stale value is served forever.
+func Detach(ctx context.Context, timeout time.Duration) context.Context {
+	d := &detachedContext{parent: ctx}
+	if timeout > 0 {
+		d.deadline = time.Now().Add(timeout)
+	}
+	return d
+}
+
+type detachedContext struct {
+	parent   context.Context
+	deadline time.Time
+
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *detachedContext) Deadline() (time.Time, bool) {
+	return c.deadline, !c.deadline.IsZero()
+}
+
+// Done starts the timer on the first call, contexts that are never waited on cost nothing
+func (c *detachedContext) Done() <-chan struct{} {
+	if c.deadline.IsZero() {
+		return nil
+	}
+	c.once.Do(func() {
+		c.done = make(chan struct{})
+		time.AfterFunc(time.Until(c.deadline), func() { close(c.done) })
+	})
+	return c.done
+}
+
+func (c *detachedContext) Err() error {
+	select {
+	case <-c.Done():
+		return context.DeadlineExceeded
+	default:
+		return nil
+	}
+}
+
+func (c *detachedContext) Value(key any) any {
+	return c.parent.Value(key)
+}
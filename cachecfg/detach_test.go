@@ -0,0 +1,35 @@
+package cachecfg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type ctxKey struct{}
+
+func TestDetach(t *testing.T) {
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), ctxKey{}, "v"))
+	cancel()
+
+	ctx := Detach(parent, 0)
+	assert.NoError(t, ctx.Err())
+	assert.Nil(t, ctx.Done())
+	assert.Equal(t, "v", ctx.Value(ctxKey{}))
+	_, ok := ctx.Deadline()
+	assert.False(t, ok)
+
+	ctx = Detach(parent, 10*time.Millisecond)
+	assert.NoError(t, ctx.Err())
+	deadline, ok := ctx.Deadline()
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now().Add(10*time.Millisecond), deadline, 10*time.Millisecond)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("detached context is not done after its timeout")
+	}
+	assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+}
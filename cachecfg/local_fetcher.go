@@ -0,0 +1,186 @@
+package cachecfg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrKeyNotFound is returned by local fetchers when they have no value for the key,
+// OverrideFetcher falls through to the next layer on it.
+var ErrKeyNotFound = errors.New("key not found")
+
+var _ ValueFetcher[string] = &EnvValueFetcher[string]{}
+var _ ValueFetcher[string] = &StaticValueFetcher[string]{}
+
+// DefaultKey joins the non-context args with ":", e.g. (ctx, "a", 1) -> "a:1".
+// It matches RedisKeyValueFetcher.Key for the usual (ctx, key) args.
+func DefaultKey(args ...any) string {
+	parts := make([]string, 0, len(args))
+	for _, arg := range args {
+		if _, ok := arg.(context.Context); ok {
+			continue
+		}
+		parts = append(parts, fmt.Sprint(arg))
+	}
+	return strings.Join(parts, ":")
+}
+
+// ParseString keeps the raw string
+func ParseString(s string) (string, error) {
+	return s, nil
+}
+
+// ParseBytes converts the raw string to []byte, for overriding RedisKeyValueFetcher
+func ParseBytes(s string) ([]byte, error) {
+	return []byte(s), nil
+}
+
+// ParseJSON decodes the raw string as JSON
+func ParseJSON[T any](s string) (T, error) {
+	var v T
+	err := json.Unmarshal([]byte(s), &v)
+	return v, err
+}
+
+// EnvValueFetcher resolves keys from environment variables.
+// The variable name is Mapping[key] if present, otherwise Prefix + the key upper-cased
+// with every non alphanumeric character replaced by '_', e.g. "activity:1" -> "CFG_ACTIVITY_1".
+type EnvValueFetcher[T any] struct {
+	Prefix  string
+	Mapping map[string]string
+	KeyFunc func(args ...any) string // nil means DefaultKey
+	Parse   func(string) (T, error)
+
+	// LookupEnv is os.LookupEnv when nil, can be replaced in tests
+	LookupEnv func(string) (string, bool)
+}
+
+// NewEnvValueFetcher creates an EnvValueFetcher with the default key mapping
+func NewEnvValueFetcher[T any](prefix string, parse func(string) (T, error)) *EnvValueFetcher[T] {
+	return &EnvValueFetcher[T]{Prefix: prefix, Parse: parse}
+}
+
+func (e *EnvValueFetcher[T]) Key(args ...any) string {
+	if e.KeyFunc != nil {
+		return e.KeyFunc(args...)
+	}
+	return DefaultKey(args...)
+}
+
+// EnvName returns the environment variable name for the key
+func (e *EnvValueFetcher[T]) EnvName(key string) string {
+	if name, ok := e.Mapping[key]; ok {
+		return name
+	}
+	b := []byte(strings.ToUpper(key))
+	for i, c := range b {
+		if (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			b[i] = '_'
+		}
+	}
+	return e.Prefix + string(b)
+}
+
+func (e *EnvValueFetcher[T]) FetchValue(args ...any) (T, error) {
+	lookup := e.LookupEnv
+	if lookup == nil {
+		lookup = os.LookupEnv
+	}
+	s, ok := lookup(e.EnvName(e.Key(args...)))
+	if !ok {
+		var zero T
+		return zero, ErrKeyNotFound
+	}
+	return e.Parse(s)
+}
+
+// StaticValueFetcher resolves keys from an in-memory map, safe for concurrent use
+type StaticValueFetcher[T any] struct {
+	KeyFunc func(args ...any) string // nil means DefaultKey
+
+	mutex  sync.RWMutex
+	values map[string]T
+}
+
+// NewStaticValueFetcher creates a StaticValueFetcher holding a copy of values
+func NewStaticValueFetcher[T any](values map[string]T) *StaticValueFetcher[T] {
+	s := &StaticValueFetcher[T]{values: make(map[string]T, len(values))}
+	for k, v := range values {
+		s.values[k] = v
+	}
+	return s
+}
+
+// NewStaticValueFetcherFromStrings parses every value, e.g. the values collected by OverrideFlag
+func NewStaticValueFetcherFromStrings[T any](values map[string]string, parse func(string) (T, error)) (*StaticValueFetcher[T], error) {
+	s := &StaticValueFetcher[T]{values: make(map[string]T, len(values))}
+	for k, raw := range values {
+		v, err := parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("parse %s: %w", k, err)
+		}
+		s.values[k] = v
+	}
+	return s, nil
+}
+
+func (s *StaticValueFetcher[T]) Key(args ...any) string {
+	if s.KeyFunc != nil {
+		return s.KeyFunc(args...)
+	}
+	return DefaultKey(args...)
+}
+
+func (s *StaticValueFetcher[T]) FetchValue(args ...any) (T, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	v, ok := s.values[s.Key(args...)]
+	if !ok {
+		var zero T
+		return zero, ErrKeyNotFound
+	}
+	return v, nil
+}
+
+// Set adds or replaces the value of key
+func (s *StaticValueFetcher[T]) Set(key string, value T) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]T)
+	}
+	s.values[key] = value
+}
+
+// Delete removes key, later fetches fall through to the next layer
+func (s *StaticValueFetcher[T]) Delete(key string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.values, key)
+}
+
+// OverrideFlag collects repeated "-name key=value" command line flags, use it with flag.Var
+// and pass the result to NewStaticValueFetcherFromStrings.
+type OverrideFlag map[string]string
+
+func (o OverrideFlag) String() string {
+	parts := make([]string, 0, len(o))
+	for k, v := range o {
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (o OverrideFlag) Set(s string) error {
+	k, v, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("override %q is not key=value", s)
+	}
+	o[k] = v
+	return nil
+}
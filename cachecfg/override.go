@@ -0,0 +1,46 @@
+package cachecfg
+
+import "errors"
+
+var _ ValueFetcher[[]byte] = &OverrideFetcher[[]byte]{}
+var _ DefaultValueFetcher[[]byte] = &OverrideFetcher[[]byte]{}
+
+// OverrideFetcher wraps an origin fetcher with local override layers.
+//
+// Precedence: Overrides[0] > Overrides[1] > ... > Origin. A layer returning
+// ErrKeyNotFound falls through to the next one, any other error from a layer is
+// returned as is, so a malformed local value is never silently ignored.
+// The cache key always comes from Origin, so overrides share the cache entries
+// and the Config TTL of the origin.
+type OverrideFetcher[T any] struct {
+	Origin    ValueFetcher[T]
+	Overrides []ValueFetcher[T]
+}
+
+// NewOverrideFetcher creates an OverrideFetcher, overrides are listed from the highest precedence
+func NewOverrideFetcher[T any](origin ValueFetcher[T], overrides ...ValueFetcher[T]) *OverrideFetcher[T] {
+	return &OverrideFetcher[T]{Origin: origin, Overrides: overrides}
+}
+
+func (o *OverrideFetcher[T]) Key(args ...any) string {
+	return o.Origin.Key(args...)
+}
+
+func (o *OverrideFetcher[T]) FetchValue(args ...any) (T, error) {
+	for _, layer := range o.Overrides {
+		v, err := layer.FetchValue(args...)
+		if err == nil || !errors.Is(err, ErrKeyNotFound) {
+			return v, err
+		}
+	}
+	return o.Origin.FetchValue(args...)
+}
+
+// DefaultValue delegates to Origin, overrides never provide defaults
+func (o *OverrideFetcher[T]) DefaultValue(args ...any) (T, error) {
+	if d, ok := o.Origin.(DefaultValueFetcher[T]); ok {
+		return d.DefaultValue(args...)
+	}
+	var zero T
+	return zero, errDefaultUnimplemented
+}
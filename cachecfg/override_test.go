@@ -0,0 +1,104 @@
+package cachecfg
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type originFetcher struct {
+	values map[string][]byte
+	calls  int
+}
+
+func (o *originFetcher) Key(args ...any) string {
+	return args[1].(string)
+}
+
+func (o *originFetcher) FetchValue(args ...any) ([]byte, error) {
+	o.calls++
+	if v, ok := o.values[o.Key(args...)]; ok {
+		return v, nil
+	}
+	return nil, UseDefaultValue
+}
+
+func (o *originFetcher) DefaultValue(args ...any) ([]byte, error) {
+	return []byte("default"), nil
+}
+
+func TestEnvValueFetcher(t *testing.T) {
+	env := map[string]string{
+		"CFG_ACTIVITY_1": `{"limit":3}`,
+		"CUSTOM_NAME":    `{"limit":5}`,
+		"CFG_BAD":        `{`,
+	}
+	type activity struct {
+		Limit int `json:"limit"`
+	}
+	e := NewEnvValueFetcher[activity]("CFG_", ParseJSON[activity])
+	e.Mapping = map[string]string{"activity:2": "CUSTOM_NAME"}
+	e.LookupEnv = func(name string) (string, bool) {
+		v, ok := env[name]
+		return v, ok
+	}
+	ctx := context.Background()
+
+	assert.Equal(t, "CFG_ACTIVITY_1", e.EnvName("activity:1"))
+	v, err := e.FetchValue(ctx, "activity:1")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, v.Limit)
+	v, err = e.FetchValue(ctx, "activity", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, v.Limit)
+	_, err = e.FetchValue(ctx, "activity:3")
+	assert.ErrorIs(t, err, ErrKeyNotFound)
+	_, err = e.FetchValue(ctx, "bad")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrKeyNotFound))
+}
+
+func TestOverrideFetcher(t *testing.T) {
+	origin := &originFetcher{values: map[string][]byte{"a": []byte("origin-a"), "b": []byte("origin-b")}}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	cli := OverrideFlag{}
+	fs.Var(cli, "cfg", "config override key=value")
+	assert.NoError(t, fs.Parse([]string{"-cfg", "a=cli-a", "-cfg", "c=cli-c"}))
+	assert.Error(t, fs.Parse([]string{"-cfg", "novalue"}))
+
+	cliLayer, err := NewStaticValueFetcherFromStrings(cli, ParseBytes)
+	assert.NoError(t, err)
+	envLayer := NewEnvValueFetcher[[]byte]("CFG_", ParseBytes)
+	envLayer.LookupEnv = func(name string) (string, bool) {
+		if name == "CFG_A" || name == "CFG_B" {
+			return "env", true
+		}
+		return "", false
+	}
+
+	f := NewOverrideFetcher[[]byte](origin, cliLayer, envLayer)
+	c := NewCacheCfg[[]byte](time.Minute, false)
+	c.ValueFetcher = f
+	ctx := context.Background()
+
+	get := func(key string) string {
+		v, err := c.GetValue(ctx, key)
+		assert.NoError(t, err)
+		return string(v)
+	}
+	assert.Equal(t, "cli-a", get("a"))
+	assert.Equal(t, "env", get("b"))
+	assert.Equal(t, "cli-c", get("c"))
+	assert.Equal(t, "default", get("d"))
+	assert.Equal(t, 1, origin.calls)
+
+	cliLayer.Delete("a")
+	v, err := f.FetchValue(ctx, "a")
+	assert.NoError(t, err)
+	assert.Equal(t, "env", string(v))
+}
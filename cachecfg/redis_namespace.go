@@ -0,0 +1,289 @@
+package cachecfg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+var _ ValueFetcher[map[string][]byte] = &RedisNamespaceFetcher[[]byte]{}
+var _ ValueFetcher[*struct{}] = &RedisNamespaceStructFetcher[struct{}]{}
+
+/*
+RedisNamespaceFetcher loads every key under a prefix (e.g. "activity:123:") as one map,
+keyed by the part after the prefix. Keys are listed with SCAN and read with MGET in batches.
+
+Args are (ctx context.Context, prefix string), the prefix is also the cache key, so the whole
+namespace is one Config entry. Every fetch builds a new map and Config swaps it in under its
+lock, readers see either the old namespace or the new one, never a mix. Cached maps are shared
+between readers and must not be modified.
+*/
+type RedisNamespaceFetcher[T any] struct {
+	Rds       redis.UniversalClient
+	ScanCount int64                       // COUNT hint of SCAN, default 100
+	BatchSize int                         // keys per MGET, default 100
+	Decode    func(raw []byte) (T, error) // default json.Unmarshal
+}
+
+func (r *RedisNamespaceFetcher[T]) Key(args ...any) string {
+	// args[0] is context.Context
+	return args[1].(string)
+}
+
+func (r *RedisNamespaceFetcher[T]) FetchValue(args ...any) (map[string]T, error) {
+	ctx, ok1 := args[0].(context.Context)
+	prefix, ok2 := args[1].(string)
+	if !ok1 || !ok2 {
+		return nil, badParams
+	}
+	raw, err := fetchNamespace(ctx, r.Rds, prefix, r.ScanCount, r.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string]T, len(raw))
+	for k, b := range raw {
+		var v T
+		if r.Decode != nil {
+			v, err = r.Decode(b)
+		} else {
+			err = json.Unmarshal(b, &v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode %s%s: %w", prefix, k, err)
+		}
+		ret[k] = v
+	}
+	return ret, nil
+}
+
+/*
+RedisNamespaceStructFetcher loads every key under a prefix into a struct, fields are matched
+by the `redis` tag against the part of the key after the prefix:
+
+	type Activity struct {
+		Name    string        `redis:"name"`     // activity:123:name
+		Limit   int           `redis:"limit"`    // activity:123:limit
+		Open    bool          `redis:"open"`
+		Cooling time.Duration `redis:"cooling"`  // "1m30s" or nanoseconds
+		Rules   []Rule        `redis:"rules"`    // other types are decoded as JSON
+	}
+
+Keys without a matching field are ignored, fields without a key keep their zero value.
+Like RedisNamespaceFetcher, every fetch builds a new object.
+*/
+type RedisNamespaceStructFetcher[T any] struct {
+	Rds       redis.UniversalClient
+	ScanCount int64
+	BatchSize int
+}
+
+func (r *RedisNamespaceStructFetcher[T]) Key(args ...any) string {
+	// args[0] is context.Context
+	return args[1].(string)
+}
+
+func (r *RedisNamespaceStructFetcher[T]) FetchValue(args ...any) (*T, error) {
+	ctx, ok1 := args[0].(context.Context)
+	prefix, ok2 := args[1].(string)
+	if !ok1 || !ok2 {
+		return nil, badParams
+	}
+	raw, err := fetchNamespace(ctx, r.Rds, prefix, r.ScanCount, r.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	v := new(T)
+	if err := assignFields(raw, v); err != nil {
+		return nil, fmt.Errorf("namespace %s: %w", prefix, err)
+	}
+	return v, nil
+}
+
+// fetchNamespace returns the raw values under prefix, keys deleted between SCAN and MGET are skipped
+func fetchNamespace(ctx context.Context, rds redis.UniversalClient, prefix string, scanCount int64, batchSize int) (map[string][]byte, error) {
+	if scanCount <= 0 {
+		scanCount = 100
+	}
+	if batchSize <= 0 {
+		batchSize = 100
+	}
+
+	keys, err := scanKeys(ctx, rds, escapeGlob(prefix)+"*", scanCount)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make(map[string][]byte, len(keys))
+	for start := 0; start < len(keys); start += batchSize {
+		end := start + batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		vals, err := mget(ctx, rds, keys[start:end])
+		if err != nil {
+			return nil, err
+		}
+		for i, v := range vals {
+			if s, ok := v.(string); ok {
+				ret[strings.TrimPrefix(keys[start+i], prefix)] = []byte(s)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// scanKeys lists the keys matching match, a cluster is scanned on every master
+func scanKeys(ctx context.Context, rds redis.UniversalClient, match string, count int64) ([]string, error) {
+	keys := make([]string, 0)
+	seen := make(map[string]bool)
+	var mutex sync.Mutex
+	scan := func(ctx context.Context, c redis.Cmdable) error {
+		iter := c.Scan(ctx, 0, match, count).Iterator()
+		for iter.Next(ctx) {
+			mutex.Lock()
+			// SCAN may return a key more than once
+			if k := iter.Val(); !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+			mutex.Unlock()
+		}
+		return iter.Err()
+	}
+
+	if cc, ok := rds.(*redis.ClusterClient); ok {
+		err := cc.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+			return scan(ctx, node)
+		})
+		return keys, err
+	}
+	return keys, scan(ctx, rds)
+}
+
+// mget is MGET, a cluster reads the keys with a pipeline of GET as they may be in different slots
+func mget(ctx context.Context, rds redis.UniversalClient, keys []string) ([]interface{}, error) {
+	if _, ok := rds.(*redis.ClusterClient); !ok {
+		return rds.MGet(ctx, keys...).Result()
+	}
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := rds.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range keys {
+			cmds[i] = pipe.Get(ctx, k)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	vals := make([]interface{}, len(keys))
+	for i, cmd := range cmds {
+		switch cmd.Err() {
+		case nil:
+			vals[i] = cmd.Val()
+		case redis.Nil:
+		default:
+			return nil, cmd.Err()
+		}
+	}
+	return vals, nil
+}
+
+// escapeGlob escapes the glob special characters of SCAN MATCH
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// assignFields sets the `redis` tagged fields of the struct pointed by out
+func assignFields(raw map[string][]byte, out any) error {
+	rv := reflect.ValueOf(out)
+	if rv.Kind() != reflect.Pointer || rv.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("%T is not a pointer to struct", out)
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		field := rt.Field(i)
+		name := field.Tag.Get("redis")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		b, ok := raw[name]
+		if !ok {
+			continue
+		}
+		if err := setField(rv.Field(i), b); err != nil {
+			return fmt.Errorf("field %s: %w", field.Name, err)
+		}
+	}
+	return nil
+}
+
+func setField(fv reflect.Value, b []byte) error {
+	s := string(b)
+	if fv.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			n, err2 := strconv.ParseInt(s, 10, 64)
+			if err2 != nil {
+				return err
+			}
+			d = time.Duration(n)
+		}
+		fv.SetInt(int64(d))
+		return nil
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		fv.SetString(s)
+	case reflect.Bool:
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		fv.SetBool(v)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v, err := strconv.ParseInt(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetInt(v)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, err := strconv.ParseUint(s, 10, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetUint(v)
+	case reflect.Float32, reflect.Float64:
+		v, err := strconv.ParseFloat(s, fv.Type().Bits())
+		if err != nil {
+			return err
+		}
+		fv.SetFloat(v)
+	default:
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Uint8 {
+			fv.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+		return json.Unmarshal(b, fv.Addr().Interface())
+	}
+	return nil
+}
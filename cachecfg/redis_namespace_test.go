@@ -0,0 +1,79 @@
+package cachecfg
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wlbgo/utils/internal/redistest"
+)
+
+type testActivity struct {
+	Name    string        `redis:"name"`
+	Limit   int           `redis:"limit"`
+	Open    bool          `redis:"open"`
+	Ratio   float64       `redis:"ratio"`
+	Cooling time.Duration `redis:"cooling"`
+	Raw     []byte        `redis:"raw"`
+	Items   []int         `redis:"items"`
+	Missing string        `redis:"missing"`
+	Ignored string
+}
+
+func TestAssignFields(t *testing.T) {
+	raw := map[string][]byte{
+		"name":    []byte("spring"),
+		"limit":   []byte("100"),
+		"open":    []byte("true"),
+		"ratio":   []byte("0.5"),
+		"cooling": []byte("1m30s"),
+		"raw":     []byte("abc"),
+		"items":   []byte("[1,2,3]"),
+		"unknown": []byte("x"),
+	}
+	a := &testActivity{}
+	assert.NoError(t, assignFields(raw, a))
+	assert.Equal(t, testActivity{
+		Name:    "spring",
+		Limit:   100,
+		Open:    true,
+		Ratio:   0.5,
+		Cooling: 90 * time.Second,
+		Raw:     []byte("abc"),
+		Items:   []int{1, 2, 3},
+	}, *a)
+
+	raw["cooling"] = []byte("1000")
+	assert.NoError(t, assignFields(raw, a))
+	assert.Equal(t, time.Microsecond, a.Cooling)
+
+	raw["limit"] = []byte("many")
+	assert.Error(t, assignFields(raw, a))
+	assert.Error(t, assignFields(raw, *a))
+}
+
+func TestEscapeGlob(t *testing.T) {
+	assert.Equal(t, `activity:123:`, escapeGlob("activity:123:"))
+	assert.Equal(t, `a\*b\?c\[d\]\\`, escapeGlob(`a*b?c[d]\`))
+}
+
+func TestRedisNamespaceFetcher_Cluster(t *testing.T) {
+	rds := redistest.NewCluster(t, 3)
+	ctx := context.Background()
+	// 不同的 key 分布在不同的节点上
+	want := map[string][]byte{}
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		assert.NoError(t, rds.Set(ctx, "ns_cluster:"+k, `"`+k+`"`, time.Minute).Err())
+		want[k] = []byte(k)
+	}
+
+	f := &RedisNamespaceFetcher[[]byte]{
+		Rds:       rds,
+		BatchSize: 4,
+		Decode:    func(raw []byte) ([]byte, error) { return raw[1 : len(raw)-1], nil },
+	}
+	got, err := f.FetchValue(ctx, "ns_cluster:")
+	assert.NoError(t, err)
+	assert.Equal(t, want, got)
+}
@@ -10,7 +10,7 @@ var _ ValueFetcher[[]byte] = &RedisKeyValueFetcher{}
 var badParams = errors.New("bad params")
 
 type RedisKeyValueFetcher struct {
-	Rds *redis.Client
+	Rds redis.UniversalClient
 
 	// 配置
 	EmptyArrayAsNil bool
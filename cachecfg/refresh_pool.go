@@ -0,0 +1,141 @@
+package cachecfg
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueueFullPolicy decides what RefreshPool.Submit does when the queue is full
+type QueueFullPolicy int
+
+const (
+	// QueueFullDrop drops the refresh immediately, the stale value keeps being served
+	QueueFullDrop QueueFullPolicy = iota
+	// QueueFullBlock waits up to BlockTimeout for a free queue slot, then drops
+	QueueFullBlock
+)
+
+// RefreshPoolStats is a snapshot of the pool metrics
+type RefreshPoolStats struct {
+	QueueDepth int   // tasks waiting in the queue
+	QueueSize  int   // capacity of the queue
+	Running    int64 // tasks being executed by workers
+	Submitted  int64 // tasks accepted into the queue
+	Completed  int64 // tasks finished by workers
+	Dropped    int64 // tasks rejected because the queue was full or the pool was stopped
+}
+
+// RefreshPool runs async cache refreshes with bounded concurrency and a bounded queue.
+// One pool can be shared by several Config instances.
+type RefreshPool struct {
+	Policy       QueueFullPolicy
+	BlockTimeout time.Duration // only used by QueueFullBlock
+
+	queue    chan func()
+	queueMu  sync.RWMutex // Submit enqueues under the read lock, Stop closes the queue under the write lock
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+
+	running   atomic.Int64
+	submitted atomic.Int64
+	completed atomic.Int64
+	dropped   atomic.Int64
+}
+
+// NewRefreshPool creates a pool with `workers` goroutines and a queue of `queueSize` pending tasks
+func NewRefreshPool(workers, queueSize int, policy QueueFullPolicy, blockTimeout time.Duration) *RefreshPool {
+	if workers <= 0 {
+		panic("workers must be greater than 0")
+	}
+	if queueSize < 0 {
+		panic("queueSize must not be negative")
+	}
+	p := &RefreshPool{
+		Policy:       policy,
+		BlockTimeout: blockTimeout,
+		queue:        make(chan func(), queueSize),
+		stopChan:     make(chan struct{}),
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Submit queues a task, returns false if the task was dropped
+func (p *RefreshPool) Submit(task func()) bool {
+	p.queueMu.RLock()
+	defer p.queueMu.RUnlock()
+	select {
+	case <-p.stopChan:
+		p.dropped.Add(1)
+		return false
+	default:
+	}
+
+	select {
+	case p.queue <- task:
+		p.submitted.Add(1)
+		return true
+	default:
+	}
+
+	if p.Policy == QueueFullBlock && p.BlockTimeout > 0 {
+		timer := time.NewTimer(p.BlockTimeout)
+		defer timer.Stop()
+		select {
+		case p.queue <- task:
+			p.submitted.Add(1)
+			return true
+		case <-timer.C:
+		case <-p.stopChan:
+		}
+	}
+	p.dropped.Add(1)
+	return false
+}
+
+// Stats returns the current pool metrics
+func (p *RefreshPool) Stats() RefreshPoolStats {
+	return RefreshPoolStats{
+		QueueDepth: len(p.queue),
+		QueueSize:  cap(p.queue),
+		Running:    p.running.Load(),
+		Submitted:  p.submitted.Load(),
+		Completed:  p.completed.Load(),
+		Dropped:    p.dropped.Load(),
+	}
+}
+
+// Stop rejects new tasks and waits until the queued and running tasks finish
+func (p *RefreshPool) Stop() {
+	p.stopOnce.Do(func() {
+		// wake up blocked submitters first, then wait for in-flight Submit calls before closing the queue,
+		// so every accepted task is run by the workers
+		close(p.stopChan)
+		p.queueMu.Lock()
+		close(p.queue)
+		p.queueMu.Unlock()
+	})
+	p.wg.Wait()
+}
+
+func (p *RefreshPool) worker() {
+	defer p.wg.Done()
+	// queued tasks still hold their in-flight marks, run them all until the queue is closed and drained
+	for task := range p.queue {
+		p.run(task)
+	}
+}
+
+func (p *RefreshPool) run(task func()) {
+	p.running.Add(1)
+	defer func() {
+		p.running.Add(-1)
+		p.completed.Add(1)
+	}()
+	task()
+}
@@ -0,0 +1,154 @@
+package cachecfg
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type slowFetcher struct {
+	calls   atomic.Int32
+	running atomic.Int32
+	maxRun  atomic.Int32
+	release chan struct{}
+}
+
+func (f *slowFetcher) Key(args ...any) string {
+	return args[0].(string)
+}
+
+func (f *slowFetcher) FetchValue(args ...any) (string, error) {
+	f.calls.Add(1)
+	n := f.running.Add(1)
+	defer f.running.Add(-1)
+	for {
+		m := f.maxRun.Load()
+		if n <= m || f.maxRun.CompareAndSwap(m, n) {
+			break
+		}
+	}
+	<-f.release
+	return "v:" + args[0].(string), nil
+}
+
+func TestRefreshPool_Drop(t *testing.T) {
+	p := NewRefreshPool(1, 1, QueueFullDrop, 0)
+	block := make(chan struct{})
+	started := make(chan struct{})
+
+	assert.True(t, p.Submit(func() { close(started); <-block }))
+	<-started
+	assert.True(t, p.Submit(func() {}))
+	assert.False(t, p.Submit(func() {}))
+
+	st := p.Stats()
+	assert.Equal(t, 1, st.QueueDepth)
+	assert.Equal(t, int64(1), st.Running)
+	assert.Equal(t, int64(1), st.Dropped)
+
+	close(block)
+	p.Stop()
+	st = p.Stats()
+	assert.Equal(t, int64(2), st.Completed)
+	assert.False(t, p.Submit(func() {}))
+}
+
+func TestRefreshPool_Block(t *testing.T) {
+	p := NewRefreshPool(1, 1, QueueFullBlock, time.Second)
+	defer p.Stop()
+	block := make(chan struct{})
+	started := make(chan struct{})
+
+	assert.True(t, p.Submit(func() { close(started); <-block }))
+	<-started
+	assert.True(t, p.Submit(func() {}))
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(block)
+	}()
+	// queue is full, wait until the worker takes the queued task
+	assert.True(t, p.Submit(func() {}))
+	assert.Equal(t, int64(0), p.Stats().Dropped)
+}
+
+func TestRefreshPool_BlockTimeout(t *testing.T) {
+	p := NewRefreshPool(1, 1, QueueFullBlock, 10*time.Millisecond)
+	block := make(chan struct{})
+	started := make(chan struct{})
+
+	assert.True(t, p.Submit(func() { close(started); <-block }))
+	<-started
+	assert.True(t, p.Submit(func() {}))
+	assert.False(t, p.Submit(func() {}))
+	assert.Equal(t, int64(1), p.Stats().Dropped)
+
+	close(block)
+	p.Stop()
+}
+
+func TestConfig_RefreshPool(t *testing.T) {
+	f := &slowFetcher{release: make(chan struct{})}
+	c := NewCacheCfg[string](time.Minute, false)
+	c.ValueFetcher = f
+	c.RefreshPool = NewRefreshPool(2, 4, QueueFullDrop, 0)
+
+	for i := 0; i < 100; i++ {
+		_, err := c.GetValueNoWait(fmt.Sprint(i))
+		assert.ErrorIs(t, err, ErrCacheMiss)
+	}
+	// at most 2 running + 4 queued, the others are dropped and their in-flight marks cleared
+	st := c.RefreshPool.Stats()
+	assert.LessOrEqual(t, st.Submitted, int64(6))
+	assert.Equal(t, int64(100), st.Submitted+st.Dropped)
+
+	close(f.release)
+	c.RefreshPool.Stop()
+	assert.Equal(t, int32(st.Submitted), f.calls.Load())
+	assert.LessOrEqual(t, f.maxRun.Load(), int32(2))
+
+	c.updatingMu.Lock()
+	assert.Empty(t, c.updating)
+	c.updatingMu.Unlock()
+
+	var wg sync.WaitGroup
+	hit := atomic.Int32{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := c.GetValueNoWait(fmt.Sprint(i)); err == nil {
+				hit.Add(1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, int32(st.Submitted), hit.Load())
+}
+
+func TestRefreshPool_StopWhileSubmitting(t *testing.T) {
+	for round := 0; round < 50; round++ {
+		p := NewRefreshPool(2, 8, QueueFullBlock, time.Millisecond)
+		var ran atomic.Int64
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					p.Submit(func() { ran.Add(1) })
+				}
+			}()
+		}
+		p.Stop()
+		wg.Wait()
+		// every accepted task runs even when it was queued concurrently with Stop
+		st := p.Stats()
+		assert.Equal(t, st.Submitted, ran.Load())
+		assert.Equal(t, st.Submitted, st.Completed)
+		assert.Equal(t, int64(400), st.Submitted+st.Dropped)
+	}
+}
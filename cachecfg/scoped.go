@@ -0,0 +1,185 @@
+package cachecfg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"time"
+)
+
+var _ ValueFetcher[*struct{}] = &JSONValueFetcher[struct{}]{}
+
+// JSONValueFetcher decodes the []byte value of Source as JSON into *T.
+// An empty value decodes to nil, e.g. a missing key of RedisKeyValueFetcher with EmptyArrayAsNil.
+type JSONValueFetcher[T any] struct {
+	Source ValueFetcher[[]byte]
+}
+
+func (j *JSONValueFetcher[T]) Key(args ...any) string {
+	return j.Source.Key(args...)
+}
+
+func (j *JSONValueFetcher[T]) FetchValue(args ...any) (*T, error) {
+	raw, err := j.Source.FetchValue(args...)
+	if err != nil || len(raw) == 0 {
+		return nil, err
+	}
+	v := new(T)
+	if err := json.Unmarshal(raw, v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// ScopeLevel is one layer of a scoped config, e.g. {Name: "region", ID: "cn"}
+type ScopeLevel struct {
+	Name string
+	ID   string
+}
+
+// Resolved is the effective value of a scoped config
+type Resolved[T any] struct {
+	Value T
+
+	// Levels lists the names of the levels that have a config, from low to high precedence
+	Levels []string
+
+	// Sources maps each effective field to the level that provided it. For a non struct T
+	// the only key is "". With a custom Merge only changed fields are recorded, a level that
+	// sets a field to the value it already had does not take it over.
+	Sources map[string]string
+}
+
+/*
+ScopedResolver resolves a config that is overridden level by level, e.g.
+global -> region -> app -> user group. Each level is a separate entry of Cfg, fetched
+with (ctx, KeyFunc(level)), so every level has its own cache and TTL.
+
+Cfg returns nil (or ErrKeyNotFound) for a level that has no config, e.g. a
+JSONValueFetcher over a RedisKeyValueFetcher with EmptyArrayAsNil. The nil result is
+cached like any value, unset levels do not hit the origin on every call. Errors are
+never cached, so NewScopedResolver turns ErrKeyNotFound of the fetcher into nil; a Cfg
+built by hand should do the same, otherwise unset levels are fetched on every call.
+
+Levels are merged from low to high precedence with Merge, or by field overlay when
+Merge is nil: every non-zero exported field of a higher level replaces the field
+below. Use pointer fields when a level needs to override with a zero value.
+Cached values are never modified, but slices and maps in the result share memory
+with the cache and must be treated as read-only.
+*/
+type ScopedResolver[T any] struct {
+	Cfg     *Config[*T]
+	KeyFunc func(level ScopeLevel) string // default Name + ":" + ID
+	Merge   func(dst *T, src *T)          // default field overlay, T must be a struct
+
+	// Async reads the levels with AsyncGetValue, so a stale level never blocks. The fetch gets
+	// Detach(ctx, DetachTimeout), the background refresh does not stop with the caller's ctx
+	Async bool
+}
+
+// NewScopedResolver creates a resolver reading every level through fetcher, cached for ttl.
+// ErrKeyNotFound of fetcher is cached as nil.
+func NewScopedResolver[T any](fetcher ValueFetcher[*T], ttl time.Duration) *ScopedResolver[T] {
+	cfg := NewCacheCfg[*T](ttl, false)
+	cfg.ValueFetcher = &notFoundAsNil[T]{fetcher}
+	return &ScopedResolver[T]{Cfg: cfg}
+}
+
+// notFoundAsNil returns nil instead of ErrKeyNotFound, so the missing level is cached
+type notFoundAsNil[T any] struct {
+	ValueFetcher[*T]
+}
+
+func (n *notFoundAsNil[T]) FetchValue(args ...any) (*T, error) {
+	v, err := n.ValueFetcher.FetchValue(args...)
+	if errors.Is(err, ErrKeyNotFound) {
+		return nil, nil
+	}
+	return v, err
+}
+
+func (r *ScopedResolver[T]) key(level ScopeLevel) string {
+	if r.KeyFunc != nil {
+		return r.KeyFunc(level)
+	}
+	return level.Name + ":" + level.ID
+}
+
+// Resolve fetches levels (ordered from low to high precedence) and merges them
+func (r *ScopedResolver[T]) Resolve(ctx context.Context, levels ...ScopeLevel) (*Resolved[T], error) {
+	ret := &Resolved[T]{
+		Levels:  make([]string, 0, len(levels)),
+		Sources: make(map[string]string),
+	}
+	for _, level := range levels {
+		var v *T
+		var err error
+		if r.Async {
+			v, err = r.Cfg.AsyncGetValue(Detach(ctx, DetachTimeout), r.key(level))
+		} else {
+			v, err = r.Cfg.GetValue(ctx, r.key(level))
+		}
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil && !IsOutdatedValue(err) {
+			return nil, err
+		}
+		if v == nil {
+			continue
+		}
+
+		ret.Levels = append(ret.Levels, level.Name)
+		if r.Merge == nil {
+			overlay(&ret.Value, v, level.Name, ret.Sources)
+			continue
+		}
+		before := ret.Value
+		r.Merge(&ret.Value, v)
+		recordSources(before, ret.Value, level.Name, ret.Sources)
+	}
+	return ret, nil
+}
+
+// overlay copies the non-zero fields of src into dst, a non struct value replaces dst when non-zero
+func overlay[T any](dst *T, src *T, level string, sources map[string]string) {
+	dv := reflect.ValueOf(dst).Elem()
+	sv := reflect.ValueOf(src).Elem()
+	if sv.Kind() != reflect.Struct {
+		if !sv.IsZero() {
+			dv.Set(sv)
+			sources[""] = level
+		}
+		return
+	}
+	for i := 0; i < sv.NumField(); i++ {
+		field := sv.Type().Field(i)
+		if !field.IsExported() || sv.Field(i).IsZero() {
+			continue
+		}
+		dv.Field(i).Set(sv.Field(i))
+		sources[field.Name] = level
+	}
+}
+
+// recordSources attributes the fields changed by a custom Merge to level
+func recordSources[T any](before, after T, level string, sources map[string]string) {
+	bv := reflect.ValueOf(&before).Elem()
+	av := reflect.ValueOf(&after).Elem()
+	if av.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(before, after) {
+			sources[""] = level
+		}
+		return
+	}
+	for i := 0; i < av.NumField(); i++ {
+		field := av.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if !reflect.DeepEqual(bv.Field(i).Interface(), av.Field(i).Interface()) {
+			sources[field.Name] = level
+		}
+	}
+}
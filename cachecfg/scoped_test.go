@@ -0,0 +1,151 @@
+package cachecfg
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type testLimitCfg struct {
+	Limit   int
+	Message string
+	Enabled *bool
+	Tags    []string
+}
+
+func TestScopedResolver_Overlay(t *testing.T) {
+	off := false
+	static := NewStaticValueFetcher(map[string]*testLimitCfg{
+		"global:":   {Limit: 100, Message: "global", Tags: []string{"g"}},
+		"region:cn": {Limit: 50},
+		"app:1":     nil,
+		"group:vip": {Message: "vip", Enabled: &off},
+	})
+	static.KeyFunc = func(args ...any) string { return args[1].(string) }
+	r := NewScopedResolver[testLimitCfg](static, time.Minute)
+	ctx := context.Background()
+
+	res, err := r.Resolve(ctx,
+		ScopeLevel{Name: "global"},
+		ScopeLevel{Name: "region", ID: "cn"},
+		ScopeLevel{Name: "app", ID: "1"},
+		ScopeLevel{Name: "app", ID: "2"}, // not configured
+		ScopeLevel{Name: "group", ID: "vip"},
+	)
+	assert.NoError(t, err)
+	assert.Equal(t, 50, res.Value.Limit)
+	assert.Equal(t, "vip", res.Value.Message)
+	assert.Equal(t, &off, res.Value.Enabled)
+	assert.Equal(t, []string{"g"}, res.Value.Tags)
+	assert.Equal(t, []string{"global", "region", "group"}, res.Levels)
+	assert.Equal(t, map[string]string{
+		"Limit":   "region",
+		"Message": "group",
+		"Enabled": "group",
+		"Tags":    "global",
+	}, res.Sources)
+
+	// cached levels are not modified by merging
+	g, _ := r.Cfg.GetValue(ctx, "global:")
+	assert.Equal(t, 100, g.Limit)
+}
+
+func TestScopedResolver_Merge(t *testing.T) {
+	static := NewStaticValueFetcher(map[string]*testLimitCfg{
+		"global:":   {Limit: 100, Tags: []string{"g"}},
+		"region:cn": {Limit: 100, Tags: []string{"cn"}},
+	})
+	static.KeyFunc = func(args ...any) string { return args[1].(string) }
+	r := NewScopedResolver[testLimitCfg](static, time.Minute)
+	r.Async = true
+	// tags are appended, limits take the minimum
+	r.Merge = func(dst *testLimitCfg, src *testLimitCfg) {
+		if dst.Limit == 0 || src.Limit < dst.Limit {
+			dst.Limit = src.Limit
+		}
+		dst.Tags = append(append([]string{}, dst.Tags...), src.Tags...)
+	}
+
+	res, err := r.Resolve(context.Background(), ScopeLevel{Name: "global"}, ScopeLevel{Name: "region", ID: "cn"})
+	assert.NoError(t, err)
+	assert.Equal(t, 100, res.Value.Limit)
+	assert.Equal(t, []string{"g", "cn"}, res.Value.Tags)
+	assert.Equal(t, map[string]string{"Limit": "global", "Tags": "region"}, res.Sources)
+}
+
+func TestScopedResolver_NonStruct(t *testing.T) {
+	one, two := 1, 2
+	static := NewStaticValueFetcher(map[string]*int{"global:": &one, "app:1": &two})
+	static.KeyFunc = func(args ...any) string { return args[1].(string) }
+	r := NewScopedResolver[int](static, time.Minute)
+
+	res, err := r.Resolve(context.Background(), ScopeLevel{Name: "global"}, ScopeLevel{Name: "app", ID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.Value)
+	assert.Equal(t, map[string]string{"": "app"}, res.Sources)
+}
+
+type countingFetcher[T any] struct {
+	ValueFetcher[T]
+	calls map[string]int
+}
+
+func (c *countingFetcher[T]) FetchValue(args ...any) (T, error) {
+	c.calls[c.Key(args...)]++
+	return c.ValueFetcher.FetchValue(args...)
+}
+
+func TestScopedResolver_CacheNotFound(t *testing.T) {
+	static := NewStaticValueFetcher(map[string]*testLimitCfg{"global:": {Limit: 100}})
+	static.KeyFunc = func(args ...any) string { return args[1].(string) }
+	f := &countingFetcher[*testLimitCfg]{ValueFetcher: static, calls: map[string]int{}}
+	r := NewScopedResolver[testLimitCfg](f, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		res, err := r.Resolve(context.Background(), ScopeLevel{Name: "global"}, ScopeLevel{Name: "app", ID: "1"})
+		assert.NoError(t, err)
+		assert.Equal(t, 100, res.Value.Limit)
+		assert.Equal(t, []string{"global"}, res.Levels)
+	}
+	// the unset level is fetched once and served from the cache afterwards
+	assert.Equal(t, map[string]int{"global:": 1, "app:1": 1}, f.calls)
+}
+
+// ctxFetcher fails like a Redis client when the ctx of the call is done
+type ctxFetcher struct {
+	value atomic.Int64
+}
+
+func (f *ctxFetcher) Key(args ...any) string {
+	return args[1].(string)
+}
+
+func (f *ctxFetcher) FetchValue(args ...any) (*testLimitCfg, error) {
+	if err := args[0].(context.Context).Err(); err != nil {
+		return nil, err
+	}
+	return &testLimitCfg{Limit: int(f.value.Load())}, nil
+}
+
+func TestScopedResolver_AsyncRequestContext(t *testing.T) {
+	f := &ctxFetcher{}
+	f.value.Store(1)
+	r := NewScopedResolver[testLimitCfg](f, 10*time.Millisecond)
+	r.Async = true
+	resolve := func() int {
+		// every request cancels its ctx when it finishes
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		res, err := r.Resolve(ctx, ScopeLevel{Name: "global"})
+		assert.NoError(t, err)
+		return res.Value.Limit
+	}
+	assert.Equal(t, 1, resolve())
+
+	// the background refresh outlives the request that triggered it
+	f.value.Store(5)
+	assert.Eventually(t, func() bool { return resolve() == 5 }, time.Second, 5*time.Millisecond)
+}
@@ -13,7 +13,7 @@ import (
 )
 
 type StatHelper struct {
-	Rds           *redis.Client
+	Rds           redis.UniversalClient
 	StatKeyPrefix string
 	Period        time.Duration
 	PeriodStart   time.Time
@@ -0,0 +1,75 @@
+package flags
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/wlbgo/utils/cachecfg"
+)
+
+var _ cachecfg.ValueFetcher[*Flag] = &Fetcher{}
+
+// Fetcher 从 []byte 数据源读取开关定义，数据源为空表示开关未定义
+type Fetcher struct {
+	Source cachecfg.ValueFetcher[[]byte]
+}
+
+func (f *Fetcher) Key(args ...any) string {
+	return f.Source.Key(args...)
+}
+
+func (f *Fetcher) FetchValue(args ...any) (*Flag, error) {
+	raw, err := f.Source.FetchValue(args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	return ParseFlag(f.Key(args...), raw)
+}
+
+// Evaluator 基于 cachecfg 的开关判定，读取使用 AsyncGetValue，
+// 缓存过期后先返回旧的定义并在后台刷新，只有首次读取会等待 Redis。
+// 后台刷新在请求结束后进行，传给 Cfg 的 ctx 为 cachecfg.Detach 的结果，不随请求取消。
+type Evaluator struct {
+	Cfg       *cachecfg.Config[*Flag]
+	KeyPrefix string // Redis key 为 KeyPrefix + flag
+}
+
+// NewEvaluator 创建从 Redis 读取开关的 Evaluator，不存在的 key 视为开关关闭
+func NewEvaluator(rds redis.UniversalClient, keyPrefix string, ttl time.Duration) *Evaluator {
+	cfg := cachecfg.NewCacheCfg[*Flag](ttl, false)
+	cfg.ValueFetcher = &Fetcher{
+		Source: &cachecfg.RedisKeyValueFetcher{Rds: rds, EmptyArrayAsNil: true},
+	}
+	return &Evaluator{Cfg: cfg, KeyPrefix: keyPrefix}
+}
+
+// Flag 返回开关定义，未定义时返回 nil
+func (e *Evaluator) Flag(ctx context.Context, flag string) (*Flag, error) {
+	f, err := e.Cfg.AsyncGetValue(cachecfg.Detach(ctx, cachecfg.DetachTimeout), e.KeyPrefix+flag)
+	if err != nil && !cachecfg.IsOutdatedValue(err) {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Enabled 判断用户是否命中开关，读取失败时返回 false 和错误
+func (e *Evaluator) Enabled(ctx context.Context, flag, userID string) (bool, error) {
+	f, err := e.Flag(ctx, flag)
+	if err != nil {
+		return false, err
+	}
+	return f.Enabled(userID), nil
+}
+
+// Variant 返回用户的实验分组，未命中开关时返回空字符串
+func (e *Evaluator) Variant(ctx context.Context, flag, userID string) (string, error) {
+	f, err := e.Flag(ctx, flag)
+	if err != nil {
+		return "", err
+	}
+	return f.Variant(userID), nil
+}
@@ -0,0 +1,123 @@
+package flags
+
+import (
+	"encoding/json"
+	"hash/fnv"
+)
+
+// bucketCount 百分比按万分位分桶，Percentage 支持两位小数
+const bucketCount = 10000
+
+// Variant 实验分组，按 Weight 比例分配命中开关的用户
+type Variant struct {
+	Name   string `json:"name"`
+	Weight int    `json:"weight"`
+}
+
+// Flag 单个开关的定义，以 JSON 存放在 Redis 中，例如
+//
+//	{"on": true, "percentage": 12.5, "allow": ["u1"], "deny": ["u2"],
+//	 "variants": [{"name": "A", "weight": 1}, {"name": "B", "weight": 1}]}
+//
+// 判定顺序: On 为 false 全部关闭 -> Deny 名单关闭 -> Allow 名单打开 -> 按 Percentage 灰度
+type Flag struct {
+	Name       string    `json:"name"`
+	On         bool      `json:"on"`
+	Percentage *float64  `json:"percentage,omitempty"` // 0~100，不设置等于 100
+	Allow      []string  `json:"allow,omitempty"`
+	Deny       []string  `json:"deny,omitempty"`
+	Variants   []Variant `json:"variants,omitempty"`
+	Salt       string    `json:"salt,omitempty"` // 修改 Salt 可以重新打散用户，默认使用 Name
+
+	allow       map[string]struct{}
+	deny        map[string]struct{}
+	threshold   int
+	totalWeight int
+}
+
+// ParseFlag 解析 JSON 定义，name 用于 JSON 中没有填写 name 的情况
+func ParseFlag(name string, raw []byte) (*Flag, error) {
+	f := &Flag{}
+	if err := json.Unmarshal(raw, f); err != nil {
+		return nil, err
+	}
+	if f.Name == "" {
+		f.Name = name
+	}
+	f.prepare()
+	return f, nil
+}
+
+// prepare 预先计算名单和阈值，缓存中的 Flag 之后只读
+func (f *Flag) prepare() {
+	f.allow = make(map[string]struct{}, len(f.Allow))
+	for _, uid := range f.Allow {
+		f.allow[uid] = struct{}{}
+	}
+	f.deny = make(map[string]struct{}, len(f.Deny))
+	for _, uid := range f.Deny {
+		f.deny[uid] = struct{}{}
+	}
+
+	f.threshold = bucketCount
+	if f.Percentage != nil {
+		f.threshold = int(*f.Percentage * bucketCount / 100)
+	}
+	// 超出 0~100 的配置按边界处理，负数不能在比较时转换成很大的无符号数
+	if f.threshold < 0 {
+		f.threshold = 0
+	} else if f.threshold > bucketCount {
+		f.threshold = bucketCount
+	}
+
+	f.totalWeight = 0
+	for _, v := range f.Variants {
+		if v.Weight > 0 {
+			f.totalWeight += v.Weight
+		}
+	}
+}
+
+// Enabled 判断用户是否命中开关，nil 表示开关未定义，等同于关闭
+func (f *Flag) Enabled(userID string) bool {
+	if f == nil || !f.On {
+		return false
+	}
+	if _, ok := f.deny[userID]; ok {
+		return false
+	}
+	if _, ok := f.allow[userID]; ok {
+		return true
+	}
+	return f.bucket("rollout", userID)%bucketCount < uint32(f.threshold)
+}
+
+// Variant 返回命中的实验分组，未命中开关或没有配置分组时返回空字符串。
+// 分组与灰度使用不同的哈希，扩大灰度比例不会改变已有用户的分组。
+func (f *Flag) Variant(userID string) string {
+	if !f.Enabled(userID) || f.totalWeight == 0 {
+		return ""
+	}
+	b := int(f.bucket("variant", userID) % uint32(f.totalWeight))
+	for _, v := range f.Variants {
+		if v.Weight <= 0 {
+			continue
+		}
+		if b < v.Weight {
+			return v.Name
+		}
+		b -= v.Weight
+	}
+	return ""
+}
+
+// bucket 用户在开关上的稳定哈希，同一个用户在不同实例、不同时间结果一致
+func (f *Flag) bucket(stage, userID string) uint32 {
+	salt := f.Salt
+	if salt == "" {
+		salt = f.Name
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(salt + ":" + stage + ":" + userID))
+	return h.Sum32()
+}
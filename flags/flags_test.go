@@ -0,0 +1,174 @@
+package flags
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/wlbgo/utils/cachecfg"
+)
+
+type memSource struct {
+	data  map[string]string
+	calls atomic.Int32
+	err   error
+}
+
+func (m *memSource) Key(args ...any) string {
+	return args[1].(string)
+}
+
+func (m *memSource) FetchValue(args ...any) ([]byte, error) {
+	m.calls.Add(1)
+	if m.err != nil {
+		return nil, m.err
+	}
+	return []byte(m.data[m.Key(args...)]), nil
+}
+
+func TestFlag_Enabled(t *testing.T) {
+	f, err := ParseFlag("f1", []byte(`{"on":true,"percentage":30,"allow":["a"],"deny":["d"]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, "f1", f.Name)
+	assert.True(t, f.Enabled("a"))
+	assert.False(t, f.Enabled("d"))
+
+	hit := 0
+	for i := 0; i < 10000; i++ {
+		uid := "uid" + strconv.Itoa(i)
+		if f.Enabled(uid) {
+			hit++
+		}
+		// stable for the same user
+		assert.Equal(t, f.Enabled(uid), f.Enabled(uid))
+	}
+	assert.InDelta(t, 3000, hit, 300)
+
+	off, _ := ParseFlag("f2", []byte(`{"on":false,"allow":["a"]}`))
+	assert.False(t, off.Enabled("a"))
+
+	all, _ := ParseFlag("f3", []byte(`{"on":true}`))
+	assert.True(t, all.Enabled("anyone"))
+
+	none, _ := ParseFlag("f4", []byte(`{"on":true,"percentage":0}`))
+	assert.False(t, none.Enabled("anyone"))
+
+	var undefined *Flag
+	assert.False(t, undefined.Enabled("a"))
+	assert.Equal(t, "", undefined.Variant("a"))
+}
+
+func TestFlag_Rollout(t *testing.T) {
+	small, _ := ParseFlag("f", []byte(`{"on":true,"percentage":10}`))
+	large, _ := ParseFlag("f", []byte(`{"on":true,"percentage":50}`))
+	for i := 0; i < 1000; i++ {
+		uid := "uid" + strconv.Itoa(i)
+		if small.Enabled(uid) {
+			assert.True(t, large.Enabled(uid), "raising the percentage must keep enabled users")
+		}
+	}
+}
+
+func TestFlag_RolloutOutOfRange(t *testing.T) {
+	negative, err := ParseFlag("f", []byte(`{"on":true,"percentage":-10}`))
+	assert.NoError(t, err)
+	over, err := ParseFlag("f", []byte(`{"on":true,"percentage":150}`))
+	assert.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		uid := "uid" + strconv.Itoa(i)
+		assert.False(t, negative.Enabled(uid), "negative percentage must disable the rollout")
+		assert.True(t, over.Enabled(uid), "percentage over 100 must enable everyone")
+	}
+}
+
+func TestFlag_Variant(t *testing.T) {
+	f, _ := ParseFlag("exp", []byte(`{"on":true,"variants":[{"name":"A","weight":1},{"name":"B","weight":3},{"name":"C","weight":0}]}`))
+	cnt := map[string]int{}
+	for i := 0; i < 10000; i++ {
+		cnt[f.Variant("uid"+strconv.Itoa(i))]++
+	}
+	assert.InDelta(t, 2500, cnt["A"], 250)
+	assert.InDelta(t, 7500, cnt["B"], 250)
+	assert.Equal(t, 0, cnt["C"])
+
+	noVariant, _ := ParseFlag("f", []byte(`{"on":true}`))
+	assert.Equal(t, "", noVariant.Variant("u"))
+}
+
+func TestEvaluator(t *testing.T) {
+	src := &memSource{data: map[string]string{
+		"flag:new_ui": `{"on":true,"allow":["u1"],"percentage":0,"variants":[{"name":"A","weight":1}]}`,
+	}}
+	cfg := cachecfg.NewCacheCfg[*Flag](50*time.Millisecond, false)
+	cfg.ValueFetcher = &Fetcher{Source: src}
+	e := &Evaluator{Cfg: cfg, KeyPrefix: "flag:"}
+	ctx := context.Background()
+
+	ok, err := e.Enabled(ctx, "new_ui", "u1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	v, err := e.Variant(ctx, "new_ui", "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, "A", v)
+
+	ok, err = e.Enabled(ctx, "new_ui", "u2")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// undefined flag is off
+	ok, err = e.Enabled(ctx, "missing", "u1")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, int32(2), src.calls.Load())
+
+	// stale definition is still served while the source is failing
+	time.Sleep(60 * time.Millisecond)
+	src.err = errors.New("redis down")
+	ok, err = e.Enabled(ctx, "new_ui", "u1")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	_, err = e.Enabled(ctx, "never_loaded", "u1")
+	assert.Error(t, err)
+}
+
+// ctxSource fails like a Redis client when the ctx of the call is done
+type ctxSource struct {
+	raw atomic.Value
+}
+
+func (c *ctxSource) Key(args ...any) string {
+	return args[1].(string)
+}
+
+func (c *ctxSource) FetchValue(args ...any) ([]byte, error) {
+	if err := args[0].(context.Context).Err(); err != nil {
+		return nil, err
+	}
+	return []byte(c.raw.Load().(string)), nil
+}
+
+func TestEvaluator_RequestContext(t *testing.T) {
+	src := &ctxSource{}
+	src.raw.Store(`{"on":false}`)
+	cfg := cachecfg.NewCacheCfg[*Flag](10*time.Millisecond, false)
+	cfg.ValueFetcher = &Fetcher{Source: src}
+	e := &Evaluator{Cfg: cfg, KeyPrefix: "flag:"}
+	enabled := func() bool {
+		// every request cancels its ctx when it finishes
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		ok, err := e.Enabled(ctx, "new_ui", "u1")
+		assert.NoError(t, err)
+		return ok
+	}
+	assert.False(t, enabled())
+
+	// the background refresh outlives the request that triggered it
+	src.raw.Store(`{"on":true,"percentage":100}`)
+	assert.Eventually(t, enabled, time.Second, 5*time.Millisecond)
+}
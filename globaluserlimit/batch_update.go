@@ -0,0 +1,201 @@
+package globaluserlimit
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// batchMaxPendingRounds 缓冲最多保留 size 的多少倍，Redis 长时间不可用时超出的用户丢弃
+	batchMaxPendingRounds = 100
+	// batchCountIdleRounds 超过多少个 dur 没有写入的 key 不再保留上次写入后的数量
+	batchCountIdleRounds = 10
+)
+
+// batchFlushFunc 把缓冲的用户写入 Redis，返回写入后每个 key 的用户数
+type batchFlushFunc func(ctx context.Context, pending map[string][]string) (map[string]int, error)
+
+// batchCount 上次写入后 Redis 中的数量
+type batchCount struct {
+	n  int
+	at time.Time
+}
+
+/*
+batchBuffer 本地缓冲 InsertUser，攒够 size 个用户或者距离上次写入超过 dur 时批量写入 Redis。
+
+精度上的取舍:
+  - InsertUser 返回的数量是上次写入后 Redis 中的数量加上本地缓冲的数量，缓冲中可能有重复用户，偏大；
+  - 其他实例和 IsLimited 在写入前看不到本地缓冲的用户，最多延迟 dur；
+  - 进程异常退出会丢失缓冲中的用户，正常退出需要调用 Close；
+  - 写入失败时用户放回缓冲，等待下一次写入，缓冲最多保留 size*batchMaxPendingRounds 个用户，超出的丢弃；
+  - 超过 batchCountIdleRounds 个 dur 没有写入的 key 不再保留上次写入后的数量，之后返回的数量只有本地缓冲的部分，直到下一次写入。
+*/
+type batchBuffer struct {
+	size  int
+	dur   time.Duration
+	flush batchFlushFunc
+
+	mutex      sync.Mutex
+	pending    map[string][]string
+	pendingCnt int
+	counts     map[string]batchCount
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+// newBatchBuffer size 和 dur 有一个为 0 时不缓冲，返回 nil
+func newBatchBuffer(size int, dur time.Duration, flush batchFlushFunc) *batchBuffer {
+	if size == 0 || dur == 0 {
+		return nil
+	}
+	b := &batchBuffer{
+		size:     size,
+		dur:      dur,
+		flush:    flush,
+		pending:  make(map[string][]string),
+		counts:   make(map[string]batchCount),
+		stopChan: make(chan struct{}),
+	}
+	b.wg.Add(1)
+	go b.worker()
+	return b
+}
+
+// add 缓冲一个用户，返回近似的用户数，缓冲满时在调用方的 goroutine 中写入
+func (b *batchBuffer) add(ctx context.Context, key, uid string) (int, error) {
+	b.mutex.Lock()
+	b.push(key, uid)
+	cnt := b.counts[key].n + len(b.pending[key])
+	full := b.pendingCnt >= b.size
+	b.mutex.Unlock()
+
+	if !full {
+		return cnt, nil
+	}
+	if err := b.flushPending(ctx); err != nil {
+		return cnt, err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.counts[key].n + len(b.pending[key]), nil
+}
+
+// push 缓冲用户，超过 size*batchMaxPendingRounds 的丢弃，调用方需要持有锁
+func (b *batchBuffer) push(key string, uids ...string) {
+	if n := b.size*batchMaxPendingRounds - b.pendingCnt; len(uids) > n {
+		if n <= 0 {
+			return
+		}
+		uids = uids[:n]
+	}
+	b.pending[key] = append(b.pending[key], uids...)
+	b.pendingCnt += len(uids)
+}
+
+// flushPending 取出当前缓冲写入 Redis，失败时放回缓冲
+func (b *batchBuffer) flushPending(ctx context.Context) error {
+	b.mutex.Lock()
+	if b.pendingCnt == 0 {
+		b.mutex.Unlock()
+		return nil
+	}
+	pending := b.pending
+	b.pending = make(map[string][]string)
+	b.pendingCnt = 0
+	b.mutex.Unlock()
+
+	counts, err := b.flush(ctx, pending)
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if err != nil {
+		for key, uids := range pending {
+			b.push(key, uids...)
+		}
+		return err
+	}
+	now := time.Now()
+	for key, cnt := range counts {
+		b.counts[key] = batchCount{n: cnt, at: now}
+	}
+	return nil
+}
+
+// sweepCounts 删除长时间没有写入的 key 的数量
+func (b *batchBuffer) sweepCounts() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	expired := time.Now().Add(-batchCountIdleRounds * b.dur)
+	for key, cnt := range b.counts {
+		if cnt.at.Before(expired) && len(b.pending[key]) == 0 {
+			delete(b.counts, key)
+		}
+	}
+}
+
+func (b *batchBuffer) worker() {
+	defer b.wg.Done()
+	ticker := time.NewTicker(b.dur)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			_ = b.flushPending(ctx)
+			cancel()
+			b.sweepCounts()
+		case <-b.stopChan:
+			return
+		}
+	}
+}
+
+// close 停止定时写入，并把剩余的缓冲写入 Redis
+func (b *batchBuffer) close(ctx context.Context) error {
+	b.stopOnce.Do(func() {
+		close(b.stopChan)
+	})
+	b.wg.Wait()
+	return b.flushPending(ctx)
+}
+
+// shutdown 未开启缓冲(nil)时什么也不做，否则停止定时写入并在 5 秒内写入剩余的缓冲
+func (b *batchBuffer) shutdown() error {
+	if b == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return b.close(ctx)
+}
+
+// pipelineFlush 一次 pipeline 写入所有缓冲的用户，add 写入一个 key 的用户，count 返回写入后的用户数
+func pipelineFlush(ctx context.Context, rds redis.UniversalClient, ttl time.Duration, pending map[string][]string,
+	add func(pipe redis.Pipeliner, key string, uids []string), count func(pipe redis.Pipeliner, key string) *redis.IntCmd) (map[string]int, error) {
+	cmds := make(map[string]*redis.IntCmd, len(pending))
+	_, err := rds.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for key, uids := range pending {
+			add(pipe, key, uids)
+			if ttl != 0 {
+				pipe.Expire(ctx, key, ttl)
+			}
+			cmds[key] = count(pipe, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(cmds))
+	for key, cmd := range cmds {
+		counts[key] = int(cmd.Val())
+	}
+	return counts, nil
+}
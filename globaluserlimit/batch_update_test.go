@@ -0,0 +1,147 @@
+package globaluserlimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+type fakeFlusher struct {
+	mutex  sync.Mutex
+	users  map[string]map[string]bool
+	calls  int
+	broken bool
+}
+
+func (f *fakeFlusher) flush(ctx context.Context, pending map[string][]string) (map[string]int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls++
+	if f.broken {
+		return nil, errors.New("redis down")
+	}
+	counts := make(map[string]int)
+	for key, uids := range pending {
+		if f.users[key] == nil {
+			f.users[key] = make(map[string]bool)
+		}
+		for _, uid := range uids {
+			f.users[key][uid] = true
+		}
+		counts[key] = len(f.users[key])
+	}
+	return counts, nil
+}
+
+func (f *fakeFlusher) count(key string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return len(f.users[key])
+}
+
+func TestBatchBuffer_Size(t *testing.T) {
+	f := &fakeFlusher{users: make(map[string]map[string]bool)}
+	b := newBatchBuffer(3, time.Hour, f.flush)
+	ctx := context.Background()
+
+	cnt, err := b.add(ctx, "k", "u1")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, cnt)
+	cnt, _ = b.add(ctx, "k", "u1")
+	assert.Equal(t, 2, cnt) // duplicates are counted until flushed
+	assert.Equal(t, 0, f.count("k"))
+
+	cnt, err = b.add(ctx, "k", "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, 2, cnt)
+	assert.Equal(t, 2, f.count("k"))
+	assert.Equal(t, 1, f.calls)
+
+	_, _ = b.add(ctx, "k", "u3")
+	assert.NilError(t, b.close(ctx))
+	assert.Equal(t, 3, f.count("k"))
+}
+
+func TestBatchBuffer_Dur(t *testing.T) {
+	f := &fakeFlusher{users: make(map[string]map[string]bool)}
+	b := newBatchBuffer(100, 50*time.Millisecond, f.flush)
+	defer b.close(context.Background())
+
+	_, _ = b.add(context.Background(), "k1", "u1")
+	_, _ = b.add(context.Background(), "k2", "u1")
+	time.Sleep(120 * time.Millisecond)
+	assert.Equal(t, 1, f.count("k1"))
+	assert.Equal(t, 1, f.count("k2"))
+}
+
+func TestBatchBuffer_Retry(t *testing.T) {
+	f := &fakeFlusher{users: make(map[string]map[string]bool), broken: true}
+	b := newBatchBuffer(2, time.Hour, f.flush)
+	ctx := context.Background()
+
+	_, _ = b.add(ctx, "k", "u1")
+	_, err := b.add(ctx, "k", "u2")
+	assert.ErrorContains(t, err, "redis down")
+
+	f.mutex.Lock()
+	f.broken = false
+	f.mutex.Unlock()
+	cnt, err := b.add(ctx, "k", "u3")
+	assert.NilError(t, err)
+	assert.Equal(t, 3, cnt)
+	assert.NilError(t, b.close(ctx))
+}
+
+func TestNewBatchBuffer_Disabled(t *testing.T) {
+	f := &fakeFlusher{}
+	assert.Assert(t, newBatchBuffer(0, time.Second, f.flush) == nil)
+	assert.Assert(t, newBatchBuffer(10, 0, f.flush) == nil)
+}
+
+func TestBatchBuffer_MaxPending(t *testing.T) {
+	f := &fakeFlusher{users: make(map[string]map[string]bool), broken: true}
+	b := newBatchBuffer(2, time.Hour, f.flush)
+	ctx := context.Background()
+
+	// Redis 不可用时缓冲不会无限增长
+	for i := 0; i < 3*2*batchMaxPendingRounds; i++ {
+		_, _ = b.add(ctx, "k", fmt.Sprint("u", i))
+	}
+	b.mutex.Lock()
+	assert.Equal(t, 2*batchMaxPendingRounds, b.pendingCnt)
+	assert.Equal(t, 2*batchMaxPendingRounds, len(b.pending["k"]))
+	b.mutex.Unlock()
+
+	f.mutex.Lock()
+	f.broken = false
+	f.mutex.Unlock()
+	assert.NilError(t, b.close(ctx))
+	assert.Equal(t, 2*batchMaxPendingRounds, f.count("k"))
+}
+
+func TestBatchBuffer_SweepCounts(t *testing.T) {
+	f := &fakeFlusher{users: make(map[string]map[string]bool)}
+	b := newBatchBuffer(1, time.Millisecond, f.flush)
+	defer b.close(context.Background())
+
+	cnt, err := b.add(context.Background(), "k", "u1")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, cnt)
+	// 长时间没有写入的 key 不再保留数量
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		b.mutex.Lock()
+		_, ok := b.counts["k"]
+		b.mutex.Unlock()
+		if !ok {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("idle count is not swept")
+}
@@ -0,0 +1,63 @@
+package globaluserlimit_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wlbgo/utils/globaluserlimit"
+	"github.com/wlbgo/utils/globaluserlimit/limittest"
+	"github.com/wlbgo/utils/internal/redistest"
+	"gotest.tools/assert"
+)
+
+// TestCluster 在本地启动的 3 节点 Redis Cluster 上运行一致性测试，没有 redis-server 时跳过
+func TestCluster(t *testing.T) {
+	rds := redistest.NewCluster(t, 3)
+
+	t.Run("RedisHLL", func(t *testing.T) {
+		limittest.Run(t, func(t *testing.T) globaluserlimit.LimitElem {
+			hll, err := globaluserlimit.NewRedisHLL(rds, time.Minute, 0, 0)
+			assert.NilError(t, err)
+			return &globaluserlimit.RedisHLLSingleKeyImpl{RedisHLL: *hll}
+		})
+	})
+	t.Run("RedisHash", func(t *testing.T) {
+		limittest.Run(t, func(t *testing.T) globaluserlimit.LimitElem {
+			hash, err := globaluserlimit.NewRedisHash(rds, time.Minute, 0, 0)
+			assert.NilError(t, err)
+			return &globaluserlimit.RedisHashSingleKeyImpl{RedisHash: *hash}
+		})
+	})
+	t.Run("RedisSet", func(t *testing.T) {
+		limittest.Run(t, func(t *testing.T) globaluserlimit.LimitElem {
+			set, err := globaluserlimit.NewRedisSet(rds, time.Minute)
+			assert.NilError(t, err)
+			return &globaluserlimit.RedisSetSingleKeyImpl{RedisSet: *set}
+		})
+	})
+	t.Run("RedisSlidingWindow", func(t *testing.T) {
+		limittest.Run(t, func(t *testing.T) globaluserlimit.LimitElem {
+			s, err := globaluserlimit.NewRedisSlidingWindow(rds, time.Minute, time.Second)
+			assert.NilError(t, err)
+			return &globaluserlimit.RedisSlidingWindowSingleKeyImpl{RedisSlidingWindow: *s}
+		})
+	})
+
+	// 预留使用与用户 hash 同一个 slot 的 zset
+	t.Run("Reservation", func(t *testing.T) {
+		hash, err := globaluserlimit.NewRedisHash(rds, time.Minute, 0, 0)
+		assert.NilError(t, err)
+		ulh := globaluserlimit.UserLimitHelper{LimitElem: &globaluserlimit.RedisHashSingleKeyImpl{RedisHash: *hash}}
+		ctx := context.Background()
+		k := "cluster_test_reservation"
+		defer rds.Del(ctx, k, "{"+k+"}:resv")
+
+		r, ret, err := ulh.Reserve(ctx, 1, "u1", time.Minute, k)
+		assert.NilError(t, err)
+		assert.Equal(t, globaluserlimit.InsertAdmitted, ret)
+		ok, err := ulh.Commit(ctx, r)
+		assert.NilError(t, err)
+		assert.Assert(t, ok)
+	})
+}
@@ -0,0 +1,59 @@
+package globaluserlimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/wlbgo/utils/globaluserlimit"
+	"github.com/wlbgo/utils/globaluserlimit/limittest"
+	"gotest.tools/assert"
+)
+
+func TestConformance_MemoryLimit(t *testing.T) {
+	limittest.Run(t, func(t *testing.T) globaluserlimit.LimitElem {
+		m, err := globaluserlimit.NewMemoryLimit(time.Minute)
+		assert.NilError(t, err)
+		return &globaluserlimit.MemoryLimitSingleKeyImpl{MemoryLimit: *m}
+	})
+}
+
+func TestConformance_RedisHLL(t *testing.T) {
+	limittest.Run(t, func(t *testing.T) globaluserlimit.LimitElem {
+		hll, err := globaluserlimit.NewRedisHLL(globaluserlimit.NewTestRedis(t), time.Minute, 0, 0)
+		assert.NilError(t, err)
+		return &globaluserlimit.RedisHLLSingleKeyImpl{RedisHLL: *hll}
+	})
+}
+
+func TestConformance_RedisHash(t *testing.T) {
+	limittest.Run(t, func(t *testing.T) globaluserlimit.LimitElem {
+		hash, err := globaluserlimit.NewRedisHash(globaluserlimit.NewTestRedis(t), time.Minute, 0, 0)
+		assert.NilError(t, err)
+		return &globaluserlimit.RedisHashSingleKeyImpl{RedisHash: *hash}
+	})
+}
+
+func TestConformance_RedisSet(t *testing.T) {
+	limittest.Run(t, func(t *testing.T) globaluserlimit.LimitElem {
+		set, err := globaluserlimit.NewRedisSet(globaluserlimit.NewTestRedis(t), time.Minute)
+		assert.NilError(t, err)
+		return &globaluserlimit.RedisSetSingleKeyImpl{RedisSet: *set}
+	})
+}
+
+func TestConformance_RedisSlidingWindow(t *testing.T) {
+	limittest.Run(t, func(t *testing.T) globaluserlimit.LimitElem {
+		s, err := globaluserlimit.NewRedisSlidingWindow(globaluserlimit.NewTestRedis(t), time.Minute, time.Second)
+		assert.NilError(t, err)
+		return &globaluserlimit.RedisSlidingWindowSingleKeyImpl{RedisSlidingWindow: *s}
+	})
+}
+
+func TestConformance_RedisLease(t *testing.T) {
+	limittest.Run(t, func(t *testing.T) globaluserlimit.LimitElem {
+		l, err := globaluserlimit.NewRedisLease(globaluserlimit.NewTestRedis(t), time.Minute, 2, time.Minute)
+		assert.NilError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+		return &globaluserlimit.RedisLeaseSingleKeyImpl{RedisLease: *l}
+	})
+}
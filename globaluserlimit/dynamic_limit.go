@@ -0,0 +1,137 @@
+package globaluserlimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/wlbgo/utils/cachecfg"
+)
+
+// UseConfiguredLimit 作为 limit 参数时从 UserLimitHelper.Limits 读取限量，其他值仍然直接使用
+const UseConfiguredLimit = -1
+
+var ErrLimitNotConfigured = errors.New("limit not configured")
+
+var (
+	_ LimitSource                       = &ConfigLimits{}
+	_ LimitSource                       = &IntConfigLimits{}
+	_ cachecfg.ValueFetcher[*LimitRule] = &LimitRuleFetcher{}
+)
+
+// LimitSource 按 key 返回限量，key 为 LimitElem.Key(args...)，不包含 Window 的后缀，同一个规则的所有窗口使用相同的限量
+type LimitSource interface {
+	Limit(ctx context.Context, key string) (int, error)
+}
+
+// LimitRule 配置的限量规则
+type LimitRule struct {
+	Limit     int  `json:"limit"`
+	Unlimited bool `json:"unlimited"` // 不限量，用户仍然计入，Count 等查询不受影响
+}
+
+func (r *LimitRule) limit() (int, error) {
+	if r.Unlimited {
+		return math.MaxInt32, nil
+	}
+	if r.Limit < 0 {
+		return 0, ErrBadConfig
+	}
+	return r.Limit, nil
+}
+
+// ParseLimitRule 解析 JSON 格式的 LimitRule，也可以直接是一个数字，例如 100 和 {"limit": 100} 相同
+func ParseLimitRule(raw []byte) (*LimitRule, error) {
+	s := strings.TrimSpace(string(raw))
+	if n, err := strconv.Atoi(s); err == nil {
+		return &LimitRule{Limit: n}, nil
+	}
+	r := &LimitRule{}
+	if err := json.Unmarshal([]byte(s), r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// LimitRuleFetcher 从 []byte 数据源读取 LimitRule，数据源为空表示没有配置，返回 nil
+type LimitRuleFetcher struct {
+	Source cachecfg.ValueFetcher[[]byte]
+}
+
+func (f *LimitRuleFetcher) Key(args ...any) string {
+	return f.Source.Key(args...)
+}
+
+func (f *LimitRuleFetcher) FetchValue(args ...any) (*LimitRule, error) {
+	raw, err := f.Source.FetchValue(args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	return ParseLimitRule(raw)
+}
+
+// ConfigLimits 基于 cachecfg 的 LimitSource，Config 的参数为 (ctx, KeyPrefix+key)。
+// 读取使用 AsyncGetValue，缓存过期后先返回旧的限量并在后台刷新，只有首次读取会等待。
+// 后台刷新在请求结束后进行，传给 Config 的 ctx 为 cachecfg.Detach 的结果，不随请求取消，超时为 cachecfg.DetachTimeout
+type ConfigLimits struct {
+	Cfg       *cachecfg.Config[*LimitRule]
+	KeyPrefix string
+}
+
+// NewRedisLimits 创建从 Redis 读取限量的 ConfigLimits，key 为 KeyPrefix + LimitElem.Key(args...)，
+// 值的格式见 ParseLimitRule，不存在的 key 返回 ErrLimitNotConfigured
+func NewRedisLimits(rds redis.UniversalClient, keyPrefix string, ttl time.Duration) *ConfigLimits {
+	cfg := cachecfg.NewCacheCfg[*LimitRule](ttl, false)
+	cfg.ValueFetcher = &LimitRuleFetcher{
+		Source: &cachecfg.RedisKeyValueFetcher{Rds: rds, EmptyArrayAsNil: true},
+	}
+	return &ConfigLimits{Cfg: cfg, KeyPrefix: keyPrefix}
+}
+
+func (c *ConfigLimits) Limit(ctx context.Context, key string) (int, error) {
+	r, err := c.Cfg.AsyncGetValue(cachecfg.Detach(ctx, cachecfg.DetachTimeout), c.KeyPrefix+key)
+	if err != nil && !cachecfg.IsOutdatedValue(err) {
+		return 0, err
+	}
+	if r == nil {
+		return 0, ErrLimitNotConfigured
+	}
+	return r.limit()
+}
+
+// IntConfigLimits 基于 cachecfg.Config[int] 的 LimitSource，Config 的参数为 (ctx, KeyPrefix+key)，
+// ctx 的处理与 ConfigLimits 相同
+type IntConfigLimits struct {
+	Cfg       *cachecfg.Config[int]
+	KeyPrefix string
+}
+
+func (c *IntConfigLimits) Limit(ctx context.Context, key string) (int, error) {
+	n, err := c.Cfg.AsyncGetValue(cachecfg.Detach(ctx, cachecfg.DetachTimeout), c.KeyPrefix+key)
+	if err != nil && !cachecfg.IsOutdatedValue(err) {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, ErrBadConfig
+	}
+	return n, nil
+}
+
+// resolveLimit limit 为 UseConfiguredLimit 时从 Limits 读取 args 对应的限量，没有设置 Limits 时返回 ErrBadConfig
+func (h *UserLimitHelper) resolveLimit(ctx context.Context, limit int, args ...any) (int, error) {
+	if limit != UseConfiguredLimit {
+		return limit, nil
+	}
+	if h.Limits == nil {
+		return 0, ErrBadConfig
+	}
+	return h.Limits.Limit(ctx, h.LimitElem.Key(args...))
+}
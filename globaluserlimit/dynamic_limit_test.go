@@ -0,0 +1,194 @@
+package globaluserlimit
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/wlbgo/utils/cachecfg"
+	"gotest.tools/assert"
+)
+
+func TestParseLimitRule(t *testing.T) {
+	cases := []struct {
+		raw     string
+		want    LimitRule
+		wantErr bool
+	}{
+		{"100", LimitRule{Limit: 100}, false},
+		{" 5\n", LimitRule{Limit: 5}, false},
+		{`{"limit": 10}`, LimitRule{Limit: 10}, false},
+		{`{"unlimited": true}`, LimitRule{Unlimited: true}, false},
+		{"abc", LimitRule{}, true},
+	}
+	for _, c := range cases {
+		r, err := ParseLimitRule([]byte(c.raw))
+		if c.wantErr {
+			assert.Assert(t, err != nil, c.raw)
+			continue
+		}
+		assert.NilError(t, err)
+		assert.Equal(t, c.want, *r)
+	}
+}
+
+func TestUserLimitHelper_RedisLimits(t *testing.T) {
+	rds := newTestRedis(t)
+	m, err := NewMemoryLimit(0)
+	assert.NilError(t, err)
+	limits := NewRedisLimits(rds, "test:limit_rule:", time.Hour)
+	ulh := UserLimitHelper{
+		LimitElem: &MemoryLimitSingleKeyImpl{MemoryLimit: *m},
+		Limits:    limits,
+	}
+	ctx := context.Background()
+	rds.Del(ctx, "test:limit_rule:no_rule")
+	rds.Set(ctx, "test:limit_rule:"+key, `{"limit": 1}`, 0)
+	defer rds.Del(ctx, "test:limit_rule:"+key)
+
+	// 没有配置
+	_, err = ulh.TryInsertResult(ctx, UseConfiguredLimit, "u1", "no_rule")
+	assert.Equal(t, ErrLimitNotConfigured, err)
+
+	ret, err := ulh.TryInsertResult(ctx, UseConfiguredLimit, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ret, err = ulh.TryInsertResult(ctx, UseConfiguredLimit, "u2", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+
+	// 直接传入的 limit 不读取配置
+	ret, err = ulh.TryInsertResult(ctx, 2, "u2", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	n, err := ulh.Remaining(ctx, UseConfiguredLimit, key)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestRedisLimits_RequestContext(t *testing.T) {
+	rds := newTestRedis(t)
+	limits := NewRedisLimits(rds, "test:limit_rule:", 10*time.Millisecond)
+	ctx := context.Background()
+	rds.Set(ctx, "test:limit_rule:"+key, "1", 0)
+	defer rds.Del(ctx, "test:limit_rule:"+key)
+	limit := func() int {
+		// 请求结束时取消 ctx
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		n, err := limits.Limit(ctx, key)
+		assert.NilError(t, err)
+		return n
+	}
+	assert.Equal(t, 1, limit())
+
+	// 后台刷新不随触发它的请求取消
+	rds.Set(ctx, "test:limit_rule:"+key, "5", 0)
+	deadline := time.Now().Add(time.Second)
+	for limit() != 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.Equal(t, 5, limit())
+}
+
+func TestUserLimitHelper_ConfigLimitsStale(t *testing.T) {
+	src := cachecfg.NewStaticValueFetcher(map[string]int{"cfg:" + key: 1})
+	cfg := cachecfg.NewCacheCfg[int](time.Millisecond, false)
+	cfg.ValueFetcher = src
+	limits := &IntConfigLimits{Cfg: cfg, KeyPrefix: "cfg:"}
+	m, err := NewMemoryLimit(0)
+	assert.NilError(t, err)
+	ulh := UserLimitHelper{
+		LimitElem: &MemoryLimitSingleKeyImpl{MemoryLimit: *m},
+		Limits:    limits,
+	}
+	ctx := context.Background()
+
+	ret, err := ulh.TryInsertResult(ctx, UseConfiguredLimit, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ret, err = ulh.TryInsertResult(ctx, UseConfiguredLimit, "u2", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+
+	// 配置删除后继续使用旧的限量
+	src.Delete("cfg:" + key)
+	time.Sleep(2 * time.Millisecond)
+	limited, err := ulh.CheckUserLimit(ctx, UseConfiguredLimit, key)
+	assert.NilError(t, err)
+	assert.Assert(t, !limited)
+
+	// 修改配置后生效
+	src.Set("cfg:"+key, 3)
+	deadline := time.Now().Add(time.Second)
+	for {
+		n, err := limits.Limit(ctx, key)
+		assert.NilError(t, err)
+		if n == 3 || time.Now().After(deadline) {
+			assert.Equal(t, 3, n)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	ret, err = ulh.TryInsertResult(ctx, UseConfiguredLimit, "u2", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+}
+
+func TestUserLimitHelper_ConfigLimitsRaised(t *testing.T) {
+	src := cachecfg.NewStaticValueFetcher(map[string]int{"cfg:" + key: 1})
+	cfg := cachecfg.NewCacheCfg[int](time.Millisecond, false)
+	cfg.ValueFetcher = src
+	limits := &IntConfigLimits{Cfg: cfg, KeyPrefix: "cfg:"}
+	f := newFlakyLimit(t)
+	ulh := UserLimitHelper{
+		LimitElem:           f,
+		Limits:              limits,
+		LimitCacheTime:      time.Minute,
+		NotLimitedCacheTime: time.Minute,
+	}
+	ctx := context.Background()
+
+	ok, err := ulh.TryInsert(ctx, UseConfiguredLimit, "u1", key)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	ok, err = ulh.TryInsert(ctx, UseConfiguredLimit, "u2", key)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	// 限量不变时命中受限缓存，不访问 LimitElem
+	calls := atomic.LoadInt32(&f.calls)
+	ok, err = ulh.TryInsert(ctx, UseConfiguredLimit, "u3", key)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	assert.Equal(t, calls, atomic.LoadInt32(&f.calls))
+
+	// 提高限量后立即生效，不等待本地受限缓存过期
+	src.Set("cfg:"+key, 2)
+	deadline := time.Now().Add(time.Second)
+	for n, _ := limits.Limit(ctx, key); n != 2 && time.Now().Before(deadline); n, _ = limits.Limit(ctx, key) {
+		time.Sleep(time.Millisecond)
+	}
+	ok, err = ulh.TryInsert(ctx, UseConfiguredLimit, "u2", key)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	limited, err := ulh.CheckUserLimit(ctx, UseConfiguredLimit, key)
+	assert.NilError(t, err)
+	assert.Assert(t, !limited)
+}
+
+func TestUserLimitHelper_UnlimitedRule(t *testing.T) {
+	r := LimitRule{Unlimited: true, Limit: 1}
+	n, err := r.limit()
+	assert.NilError(t, err)
+	assert.Equal(t, math.MaxInt32, n)
+
+	r = LimitRule{Limit: -2}
+	_, err = r.limit()
+	assert.Equal(t, ErrBadConfig, err)
+
+	ulh := UserLimitHelper{LimitElem: &MemoryLimitSingleKeyImpl{}}
+	_, err = ulh.TryInsertResult(context.Background(), UseConfiguredLimit, "u1", key)
+	assert.Equal(t, ErrBadConfig, err)
+}
@@ -0,0 +1,3 @@
+package globaluserlimit
+
+var NewTestRedis = newTestRedis
@@ -0,0 +1,166 @@
+package globaluserlimit
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// FailPolicy Redis 不可用时 UserLimitHelper 的处理方式
+type FailPolicy int
+
+const (
+	FailError  FailPolicy = iota // 默认，返回错误，由调用方处理
+	FailOpen                     // 全部通过，TryInsertResult 返回 InsertAdmitted
+	FailClosed                   // 全部拒绝，TryInsertResult 返回 InsertRejected
+	FailLocal                    // 使用本地 MemoryLimit，每个实例限量 limit/Instances
+)
+
+const defaultProbeInterval = time.Second
+
+/*
+Fallback Redis 不可用时的降级配置，对 TryInsert 和 CheckUserLimit 生效。
+
+Policy 不是 FailError 时，Redis 返回错误按 Policy 给出结果，不返回错误。连续 ErrorBudget 次错误后进入降级状态，
+之后不再访问 Redis，每隔 ProbeInterval 探测一次，探测成功后恢复。Probe 为 nil 时用一次正常的请求作为探测，
+可以设置为 rds.Ping 之类的轻量请求。
+
+FailLocal 的本地计数只在本实例内有效，Instances 个实例总共最多计入 limit 个用户；limit 小于 Instances 时本地限量为 0，
+降级期间全部拒绝。
+恢复后本地计数不会写回 Redis，降级期间通过的用户在 Redis 中不占用名额。
+*/
+type Fallback struct {
+	Policy        FailPolicy
+	Instances     int           // FailLocal 的实例数，默认 1
+	ErrorBudget   int           // 连续错误多少次后进入降级状态，默认 1
+	ProbeInterval time.Duration // 降级状态下的探测间隔，默认 1s
+	Probe         func(ctx context.Context) error
+}
+
+// localLimit 本实例的本地限量，向下取整，保证所有实例总共不超过 limit
+func (f *Fallback) localLimit(limit int) int {
+	if f.Instances <= 1 || limit <= 0 {
+		return limit
+	}
+	return limit / f.Instances
+}
+
+// fallbackState 降级状态，零值为正常状态
+type fallbackState struct {
+	mutex     sync.Mutex
+	failures  int
+	degraded  bool
+	probing   bool
+	lastProbe time.Time
+	local     *MemoryLimitSingleKeyImpl
+}
+
+// ready 是否访问 Redis。降级状态下每个 ProbeInterval 只有一个调用方探测，设置了 Probe 时在这里执行
+func (s *fallbackState) ready(ctx context.Context, f *Fallback) bool {
+	if f.Policy == FailError {
+		return true
+	}
+	s.mutex.Lock()
+	if !s.degraded {
+		s.mutex.Unlock()
+		return true
+	}
+	interval := f.ProbeInterval
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+	now := time.Now()
+	if s.probing || now.Sub(s.lastProbe) < interval {
+		s.mutex.Unlock()
+		return false
+	}
+	s.lastProbe = now
+	if f.Probe == nil {
+		s.mutex.Unlock()
+		return true
+	}
+	s.probing = true
+	s.mutex.Unlock()
+
+	err := f.Probe(ctx)
+	s.mutex.Lock()
+	s.probing = false
+	s.mutex.Unlock()
+	s.report(ctx, f, err)
+	return err == nil
+}
+
+// report 记录一次 Redis 请求的结果，调用方取消的请求不计入，超时计入错误
+func (s *fallbackState) report(ctx context.Context, f *Fallback, err error) {
+	if f.Policy == FailError || (err != nil && errors.Is(ctx.Err(), context.Canceled)) {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err == nil {
+		s.failures, s.degraded = 0, false
+		return
+	}
+	s.failures++
+	if s.failures >= f.ErrorBudget && !s.degraded {
+		s.degraded, s.lastProbe = true, time.Now()
+	}
+}
+
+func (s *fallbackState) isDegraded() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.degraded
+}
+
+// localElem FailLocal 使用的本地计数，TTL 与 UserLimitHelper 一致
+func (s *fallbackState) localElem(ttl time.Duration) *MemoryLimitSingleKeyImpl {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.local == nil {
+		if ttl < 0 {
+			ttl = 0
+		}
+		m, _ := NewMemoryLimit(ttl)
+		s.local = &MemoryLimitSingleKeyImpl{MemoryLimit: *m}
+	}
+	return s.local
+}
+
+// Degraded 是否处于降级状态，降级期间不访问 Redis
+func (h *UserLimitHelper) Degraded() bool {
+	return h.fallback.isDegraded()
+}
+
+// failInsert Redis 不可用时 TryInsert 的结果，err 为 nil 表示处于降级状态没有访问 Redis
+func (h *UserLimitHelper) failInsert(ctx context.Context, key string, end time.Time, limit int, uid string, err error) (InsertResult, error) {
+	switch h.Fallback.Policy {
+	case FailOpen:
+		return InsertAdmitted, nil
+	case FailClosed:
+		return InsertRejected, nil
+	case FailLocal:
+		local := h.fallback.localElem(h.TTL)
+		ret, _ := local.TryInsertResult(ctx, key, h.Fallback.localLimit(limit), uid)
+		if !end.IsZero() && ret.Admitted() {
+			_, _ = local.ExpireAt(ctx, key, end)
+		}
+		return ret, nil
+	}
+	return InsertRejected, err
+}
+
+// failCheck Redis 不可用时 CheckUserLimit 的结果
+func (h *UserLimitHelper) failCheck(ctx context.Context, key string, limit int, err error) (bool, error) {
+	switch h.Fallback.Policy {
+	case FailOpen:
+		return false, nil
+	case FailClosed:
+		return true, nil
+	case FailLocal:
+		local := h.fallback.localElem(h.TTL)
+		return local.IsLimited(ctx, key, h.Fallback.localLimit(limit))
+	}
+	return false, err
+}
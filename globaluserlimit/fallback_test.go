@@ -0,0 +1,246 @@
+package globaluserlimit
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+var errDown = errors.New("redis is down")
+
+// flakyLimit down 时所有请求返回错误，calls 为实际访问的次数
+type flakyLimit struct {
+	MemoryLimitSingleKeyImpl
+	down  int32
+	calls int32
+}
+
+func newFlakyLimit(t *testing.T) *flakyLimit {
+	m, err := NewMemoryLimit(0)
+	assert.NilError(t, err)
+	return &flakyLimit{MemoryLimitSingleKeyImpl: MemoryLimitSingleKeyImpl{MemoryLimit: *m}}
+}
+
+func (f *flakyLimit) setDown(down bool) {
+	var v int32
+	if down {
+		v = 1
+	}
+	atomic.StoreInt32(&f.down, v)
+}
+
+func (f *flakyLimit) err() error {
+	atomic.AddInt32(&f.calls, 1)
+	if atomic.LoadInt32(&f.down) == 1 {
+		return errDown
+	}
+	return nil
+}
+
+func (f *flakyLimit) TryInsertResult(ctx context.Context, key string, limit int, uid string) (InsertResult, error) {
+	if err := f.err(); err != nil {
+		return InsertRejected, err
+	}
+	return f.MemoryLimitSingleKeyImpl.TryInsertResult(ctx, key, limit, uid)
+}
+
+func (f *flakyLimit) IsLimited(ctx context.Context, key string, limit int) (bool, error) {
+	if err := f.err(); err != nil {
+		return false, err
+	}
+	return f.MemoryLimitSingleKeyImpl.IsLimited(ctx, key, limit)
+}
+
+func TestUserLimitHelper_FailPolicy(t *testing.T) {
+	cases := []struct {
+		policy  FailPolicy
+		want    InsertResult
+		limited bool
+		err     error
+	}{
+		{FailError, InsertRejected, false, errDown},
+		{FailOpen, InsertAdmitted, false, nil},
+		{FailClosed, InsertRejected, true, nil},
+	}
+	for _, c := range cases {
+		f := newFlakyLimit(t)
+		f.setDown(true)
+		ulh := UserLimitHelper{LimitElem: f, Fallback: Fallback{Policy: c.policy}}
+		ctx := context.Background()
+
+		ret, err := ulh.TryInsertResult(ctx, 10, "u1", key)
+		assert.Equal(t, c.err, err)
+		assert.Equal(t, c.want, ret)
+		limited, err := ulh.CheckUserLimit(ctx, 10, key)
+		assert.Equal(t, c.err, err)
+		assert.Equal(t, c.limited, limited)
+	}
+}
+
+func TestUserLimitHelper_FailLocal(t *testing.T) {
+	f := newFlakyLimit(t)
+	f.setDown(true)
+	ulh := UserLimitHelper{LimitElem: f, Fallback: Fallback{Policy: FailLocal, Instances: 3}}
+	ctx := context.Background()
+
+	// 每个实例限量 10/3 = 3
+	want := []InsertResult{InsertAdmitted, InsertAdmitted, InsertAdmitted, InsertRejected}
+	for i, uid := range []string{"u1", "u2", "u3", "u4"} {
+		ret, err := ulh.TryInsertResult(ctx, 10, uid, key)
+		assert.NilError(t, err)
+		assert.Equal(t, want[i], ret, uid)
+	}
+	ret, err := ulh.TryInsertResult(ctx, 10, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAlreadyAdmitted, ret)
+	limited, err := ulh.CheckUserLimit(ctx, 2, key)
+	assert.NilError(t, err)
+	assert.Assert(t, limited)
+
+	// 本地计数不写入 Redis
+	f.setDown(false)
+	ulh.fallback.lastProbe = time.Time{}
+	ret, err = ulh.TryInsertResult(ctx, 10, "u4", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	n, err := f.Count(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+func TestUserLimitHelper_ErrorBudget(t *testing.T) {
+	f := newFlakyLimit(t)
+	ulh := UserLimitHelper{LimitElem: f, Fallback: Fallback{
+		Policy:        FailClosed,
+		ErrorBudget:   3,
+		ProbeInterval: 20 * time.Millisecond,
+	}}
+	ctx := context.Background()
+
+	f.setDown(true)
+	for i := 0; i < 3; i++ {
+		assert.Assert(t, !ulh.Degraded())
+		ret, err := ulh.TryInsertResult(ctx, 10, "u1", key)
+		assert.NilError(t, err)
+		assert.Equal(t, InsertRejected, ret)
+	}
+	assert.Assert(t, ulh.Degraded())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&f.calls))
+
+	// 降级期间不访问 Redis
+	for i := 0; i < 10; i++ {
+		_, err := ulh.TryInsertResult(ctx, 10, "u1", key)
+		assert.NilError(t, err)
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&f.calls))
+
+	// 探测失败继续降级
+	time.Sleep(25 * time.Millisecond)
+	_, err := ulh.TryInsertResult(ctx, 10, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&f.calls))
+	assert.Assert(t, ulh.Degraded())
+
+	// 探测成功后恢复
+	f.setDown(false)
+	time.Sleep(25 * time.Millisecond)
+	ret, err := ulh.TryInsertResult(ctx, 10, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	assert.Assert(t, !ulh.Degraded())
+
+	// 成功的请求重置错误计数
+	f.setDown(true)
+	_, _ = ulh.TryInsertResult(ctx, 10, "u1", key)
+	_, _ = ulh.TryInsertResult(ctx, 10, "u1", key)
+	f.setDown(false)
+	_, _ = ulh.TryInsertResult(ctx, 10, "u1", key)
+	f.setDown(true)
+	_, _ = ulh.TryInsertResult(ctx, 10, "u1", key)
+	assert.Assert(t, !ulh.Degraded())
+}
+
+func TestUserLimitHelper_Probe(t *testing.T) {
+	f := newFlakyLimit(t)
+	var probeOK int32
+	ulh := UserLimitHelper{LimitElem: f, Fallback: Fallback{
+		Policy:        FailOpen,
+		ProbeInterval: time.Millisecond,
+		Probe: func(ctx context.Context) error {
+			if atomic.LoadInt32(&probeOK) == 0 {
+				return errDown
+			}
+			return nil
+		},
+	}}
+	ctx := context.Background()
+
+	f.setDown(true)
+	_, err := ulh.TryInsertResult(ctx, 10, "u1", key)
+	assert.NilError(t, err)
+	assert.Assert(t, ulh.Degraded())
+
+	// Probe 失败时不访问 LimitElem
+	time.Sleep(2 * time.Millisecond)
+	ret, err := ulh.TryInsertResult(ctx, 10, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&f.calls))
+
+	f.setDown(false)
+	atomic.StoreInt32(&probeOK, 1)
+	time.Sleep(2 * time.Millisecond)
+	ret, err = ulh.TryInsertResult(ctx, 10, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&f.calls))
+	assert.Assert(t, !ulh.Degraded())
+}
+
+func TestUserLimitHelper_FailCanceled(t *testing.T) {
+	f := newFlakyLimit(t)
+	f.setDown(true)
+	ulh := UserLimitHelper{LimitElem: f, Fallback: Fallback{Policy: FailOpen}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// 调用方取消的请求不计入错误
+	_, err := ulh.TryInsertResult(ctx, 10, "u1", key)
+	assert.NilError(t, err)
+	assert.Assert(t, !ulh.Degraded())
+}
+
+func TestUserLimitHelper_FailDeadline(t *testing.T) {
+	f := newFlakyLimit(t)
+	f.setDown(true)
+	ulh := UserLimitHelper{LimitElem: f, Fallback: Fallback{Policy: FailOpen, ErrorBudget: 2}}
+
+	// Redis 卡住时请求超时，超时计入错误
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Millisecond))
+		ret, err := ulh.TryInsertResult(ctx, 10, "u1", key)
+		cancel()
+		assert.NilError(t, err)
+		assert.Equal(t, InsertAdmitted, ret)
+	}
+	assert.Assert(t, ulh.Degraded())
+}
+
+func TestFallback_LocalLimit(t *testing.T) {
+	cases := []struct {
+		instances, limit, want int
+	}{
+		{0, 10, 10},
+		{3, 10, 3},
+		{3, 2, 0},
+		{3, 0, 0},
+	}
+	for _, c := range cases {
+		f := Fallback{Policy: FailLocal, Instances: c.instances}
+		assert.Equal(t, c.want, f.localLimit(c.limit), "%d/%d", c.limit, c.instances)
+	}
+}
@@ -2,26 +2,67 @@ package globaluserlimit
 
 import (
 	"context"
+	"io"
 	"sync"
 	"time"
 )
 
+// InsertResult TryInsertResult 的结果
+type InsertResult int
+
+const (
+	InsertRejected        InsertResult = iota // 达到限量被拒绝
+	InsertAdmitted                            // 新计入，占用一个名额
+	InsertAlreadyAdmitted                     // 之前已经计入，不占用新的名额
+)
+
+// Admitted 新计入和之前已经计入都算通过
+func (r InsertResult) Admitted() bool {
+	return r == InsertAdmitted || r == InsertAlreadyAdmitted
+}
+
+func (r InsertResult) String() string {
+	switch r {
+	case InsertRejected:
+		return "rejected"
+	case InsertAdmitted:
+		return "admitted"
+	case InsertAlreadyAdmitted:
+		return "already_admitted"
+	}
+	return "unknown"
+}
+
 type LimitElem interface {
 	// InsertUser 插入用户，返回当前数量
 	InsertUser(ctx context.Context, key, uid string) (int, error)
 
 	IsLimited(ctx context.Context, key string, limit int) (bool, error)
 
-	// TryInsert 尝试插入，如果插入成功返回true，否则返回false
+	// TryInsert 尝试插入，如果插入成功返回true，否则返回false，已经计入的用户重复插入返回 true
 	TryInsert(ctx context.Context, key string, limit int, uid string) (bool, error)
 
+	// TryInsertResult 与 TryInsert 相同，区分新计入和之前已经计入，已经计入的用户重复插入返回 InsertAlreadyAdmitted，不受限量影响。
+	// RedisHash、RedisSet 精确判断用户是否已经计入，RedisHLL 为近似判断。
+	TryInsertResult(ctx context.Context, key string, limit int, uid string) (InsertResult, error)
+
 	// Key 一个实例可以支持多个key分别限量，可以用于多个道具分别限量
 	Key(args ...any) string
+
+	// Count 当前计入的用户数
+	Count(ctx context.Context, key string) (int, error)
+
+	// KeyTTL key 的剩余过期时间，没有设置过期时间时返回 NoExpire，key 不存在时返回 0。
+	// 实现普遍有 TTL 字段，所以方法名为 KeyTTL。
+	KeyTTL(ctx context.Context, key string) (time.Duration, error)
+
+	// Reset 清空 key 以及辅助 key 中的所有用户
+	Reset(ctx context.Context, key string) error
 }
 
-type limitStateCache struct {
-	limitState    bool
-	lastLimitTime time.Time
+// MemberChecker 能够精确判断用户是否已经计入的 LimitElem
+type MemberChecker interface {
+	Contains(ctx context.Context, key, uid string) (bool, error)
 }
 
 type UserLimitHelper struct {
@@ -29,84 +70,339 @@ type UserLimitHelper struct {
 
 	TTL            time.Duration // 过期时间
 	LimitCacheTime time.Duration // 如果受限制，则多长时间不做查询
+	Window         Window        // 按日历对齐的限量窗口，默认不分窗口
+
+	// LimitCacheSize 本地缓存最多保存的 key 数，默认 DefaultLimitCacheSize
+	LimitCacheSize int
+	// NotLimitedCacheTime CheckUserLimit 未受限的结果缓存多长时间，默认不缓存。
+	// 缓存期间 key 在其他实例达到限量也会返回未受限，只适合可以容忍短暂误差的查询，TryInsert 不受影响。
+	NotLimitedCacheTime time.Duration
+	// Fallback Redis 不可用时的处理方式，默认返回错误
+	Fallback Fallback
+	// Limits limit 参数为 UseConfiguredLimit 时从这里读取限量，例如 NewRedisLimits
+	Limits LimitSource
 
-	// cache 只用于被限制住，不影响未限制
-	limitStateCache map[string]*limitStateCache
+	// cache 缓存受限，以及设置了 NotLimitedCacheTime 时缓存未受限
+	limitStateCache limitedCache
 	mutex           sync.Mutex
+
+	// windowExpire 已经设置过 EXPIREAT 的窗口 key 和窗口结束时间
+	windowExpire map[string]time.Time
+	now          func() time.Time
+	fallback     fallbackState
 }
 
+// TryInsert 尝试插入用户，通过时返回 true，见 TryInsertResult
 func (h *UserLimitHelper) TryInsert(ctx context.Context, limit int, uid string, args ...any) (bool, error) {
-	key := h.LimitElem.Key(args...)
-	if h.checkLimitedCache(key) {
-		return false, nil
+	ret, err := h.TryInsertResult(ctx, limit, uid, args...)
+	return ret.Admitted(), err
+}
+
+// TryInsertResult 尝试插入用户，已经计入的用户总是通过。
+// 命中本地受限缓存时，LimitElem 实现了 MemberChecker 则查询用户是否已经计入，否则直接拒绝。
+// limit 为 UseConfiguredLimit 时从 Limits 读取，其他接收 limit 的方法相同。
+func (h *UserLimitHelper) TryInsertResult(ctx context.Context, limit int, uid string, args ...any) (InsertResult, error) {
+	key, end, err := h.key(args...)
+	if err != nil {
+		return InsertRejected, err
+	}
+	if limit, err = h.resolveLimit(ctx, limit, args...); err != nil {
+		return InsertRejected, err
+	}
+	if h.checkLimitedCache(key, limit) {
+		return h.checkMember(ctx, key, uid)
 	}
 
-	ok, err := h.LimitElem.TryInsert(ctx, key, limit, uid)
+	if !h.fallback.ready(ctx, &h.Fallback) {
+		return h.failInsert(ctx, key, end, limit, uid, nil)
+	}
+
+	ret, err := h.LimitElem.TryInsertResult(ctx, key, limit, uid)
+	h.fallback.report(ctx, &h.Fallback, err)
 
 	if err == nil {
-		if !ok {
-			h.updateLimitedCache(key)
+		if ret == InsertRejected {
+			h.updateLimitedCache(key, limit)
+		} else {
+			h.expireWindow(ctx, key, end)
 		}
-		return ok, nil
+		return ret, nil
 	} else {
-		return false, err
+		return h.failInsert(ctx, key, end, limit, uid, err)
 	}
 }
 
+// TryInsertAll 用户需要同时通过多条规则，全部通过才计入，否则不修改任何规则的计数，
+// 需要 LimitElem 实现 MultiInserter。所有规则的 key 需要有相同的 hash tag，见 HashTagKey。
+func (h *UserLimitHelper) TryInsertAll(ctx context.Context, uid string, rules ...Rule) (MultiInsertResult, error) {
+	mi, ok := h.LimitElem.(MultiInserter)
+	if !ok {
+		return MultiInsertResult{Rejected: 0}, ErrNotSupported
+	}
+
+	keys := make([]string, len(rules))
+	ends := make([]time.Time, len(rules))
+	limits := make([]int, len(rules))
+	for i, rule := range rules {
+		key, end, err := h.key(rule.Args...)
+		if err != nil {
+			return MultiInsertResult{Rejected: 0}, err
+		}
+		limit, err := h.resolveLimit(ctx, rule.Limit, rule.Args...)
+		if err != nil {
+			return MultiInsertResult{Rejected: 0}, err
+		}
+		keys[i], ends[i], limits[i] = key, end, limit
+		if h.checkLimitedCache(key, limit) {
+			ret, err := h.checkMember(ctx, key, uid)
+			if err != nil {
+				return MultiInsertResult{Rejected: 0}, err
+			}
+			if ret == InsertRejected {
+				return MultiInsertResult{Rejected: i}, nil
+			}
+		}
+	}
+
+	ret, err := mi.TryInsertAll(ctx, uid, keys, limits)
+	if err != nil {
+		return ret, err
+	}
+	if !ret.Admitted() {
+		h.updateLimitedCache(keys[ret.Rejected], limits[ret.Rejected])
+		return ret, nil
+	}
+	for i, key := range keys {
+		h.expireWindow(ctx, key, ends[i])
+	}
+	return ret, nil
+}
+
+// checkMember 已经受限时，只有已经计入的用户可以通过
+func (h *UserLimitHelper) checkMember(ctx context.Context, key, uid string) (InsertResult, error) {
+	mc, ok := h.LimitElem.(MemberChecker)
+	if !ok {
+		return InsertRejected, nil
+	}
+	in, err := mc.Contains(ctx, key, uid)
+	if err != nil {
+		return InsertRejected, err
+	}
+	if in {
+		return InsertAlreadyAdmitted, nil
+	}
+	return InsertRejected, nil
+}
+
 func (h *UserLimitHelper) CheckUserLimit(ctx context.Context, limit int, args ...any) (bool, error) {
-	key := h.LimitElem.Key(args...)
+	key, _, err := h.key(args...)
+	if err != nil {
+		return false, err
+	}
 
-	retInCache := h.checkLimitedCache(key)
-	if retInCache {
-		return true, nil
+	if limit, err = h.resolveLimit(ctx, limit, args...); err != nil {
+		return false, err
+	}
+	if h.LimitCacheTime > 0 || h.NotLimitedCacheTime > 0 {
+		if limited, _, ok := h.limitStateCache.get(key, limit); ok {
+			return limited, nil
+		}
+	}
+
+	if !h.fallback.ready(ctx, &h.Fallback) {
+		return h.failCheck(ctx, key, limit, nil)
 	}
 
 	state, err := h.LimitElem.IsLimited(ctx, key, limit)
-	if err == nil && state {
-		h.updateLimitedCache(key)
+	h.fallback.report(ctx, &h.Fallback, err)
+	if err != nil {
+		return h.failCheck(ctx, key, limit, err)
+	}
+	if state {
+		h.updateLimitedCache(key, limit)
+	} else {
+		h.limitStateCache.set(key, false, limit, h.NotLimitedCacheTime, h.LimitCacheSize)
 	}
-	return state, err
+	return state, nil
 }
 
 func (h *UserLimitHelper) UpdateUser(ctx context.Context, uid string, args ...any) (int, error) {
-	key := h.LimitElem.Key(args...)
-	return h.LimitElem.InsertUser(ctx, key, uid)
+	key, end, err := h.key(args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := h.LimitElem.InsertUser(ctx, key, uid)
+	if err == nil {
+		h.expireWindow(ctx, key, end)
+	}
+	return n, err
 }
 
-func (h *UserLimitHelper) checkLimitedCache(key string) bool {
-	if h.LimitCacheTime == 0 {
-		return false
+// Count 当前计入的用户数，设置了 Window 时为当前窗口
+func (h *UserLimitHelper) Count(ctx context.Context, args ...any) (int, error) {
+	key, _, err := h.key(args...)
+	if err != nil {
+		return 0, err
+	}
+	return h.LimitElem.Count(ctx, key)
+}
+
+// Remaining 还可以计入多少个新用户，不小于 0
+func (h *UserLimitHelper) Remaining(ctx context.Context, limit int, args ...any) (int, error) {
+	limit, err := h.resolveLimit(ctx, limit, args...)
+	if err != nil {
+		return 0, err
+	}
+	n, err := h.Count(ctx, args...)
+	if err != nil {
+		return 0, err
+	}
+	if n >= limit {
+		return 0, nil
+	}
+	return limit - n, nil
+}
+
+// KeyTTL key 的剩余过期时间，见 LimitElem.KeyTTL
+func (h *UserLimitHelper) KeyTTL(ctx context.Context, args ...any) (time.Duration, error) {
+	key, _, err := h.key(args...)
+	if err != nil {
+		return 0, err
 	}
-	if h.limitStateCache == nil {
-		h.mutex.Lock()
-		defer h.mutex.Unlock()
-		if h.limitStateCache == nil {
-			h.limitStateCache = make(map[string]*limitStateCache)
+	return h.LimitElem.KeyTTL(ctx, key)
+}
+
+// Reset 清空计数，同时清除本实例的受限缓存，其他实例的受限缓存在 LimitCacheTime 后失效
+func (h *UserLimitHelper) Reset(ctx context.Context, args ...any) error {
+	key, _, err := h.key(args...)
+	if err != nil {
+		return err
+	}
+	if err := h.LimitElem.Reset(ctx, key); err != nil {
+		return err
+	}
+	h.clearLimitedCache(key)
+	h.mutex.Lock()
+	delete(h.windowExpire, key)
+	h.mutex.Unlock()
+	return nil
+}
+
+// Reserve 预留一个名额，需要 LimitElem 实现 Reserver，否则返回 ErrNotSupported
+func (h *UserLimitHelper) Reserve(ctx context.Context, limit int, uid string, ttl time.Duration, args ...any) (*Reservation, InsertResult, error) {
+	rs, ok := h.LimitElem.(Reserver)
+	if !ok {
+		return nil, InsertRejected, ErrNotSupported
+	}
+	key, end, err := h.key(args...)
+	if err != nil {
+		return nil, InsertRejected, err
+	}
+	if limit, err = h.resolveLimit(ctx, limit, args...); err != nil {
+		return nil, InsertRejected, err
+	}
+	if h.checkLimitedCache(key, limit) {
+		ret, err := h.checkMember(ctx, key, uid)
+		if err != nil || ret == InsertRejected {
+			return nil, ret, err
 		}
 	}
-	if c, ok := h.limitStateCache[key]; ok && c.limitState && time.Since(c.lastLimitTime) < h.LimitCacheTime {
-		return true
+
+	r, ret, err := rs.Reserve(ctx, key, limit, uid, ttl)
+	if err == nil {
+		if ret == InsertRejected {
+			h.updateLimitedCache(key, limit)
+		} else {
+			h.expireWindow(ctx, key, end)
+		}
 	}
-	return false
+	return r, ret, err
 }
 
-func (h *UserLimitHelper) updateLimitedCache(key string) {
-	if h.LimitCacheTime == 0 {
+// Commit 确认预留，预留已经过期被回收时返回 false
+func (h *UserLimitHelper) Commit(ctx context.Context, r *Reservation) (bool, error) {
+	rs, ok := h.LimitElem.(Reserver)
+	if !ok {
+		return false, ErrNotSupported
+	}
+	return rs.Commit(ctx, r)
+}
+
+// Cancel 取消预留，释放的名额立即可用，同时清除本地的受限缓存
+func (h *UserLimitHelper) Cancel(ctx context.Context, r *Reservation) (bool, error) {
+	rs, ok := h.LimitElem.(Reserver)
+	if !ok {
+		return false, ErrNotSupported
+	}
+	ok, err := rs.Cancel(ctx, r)
+	if ok {
+		h.clearLimitedCache(r.Key)
+	}
+	return ok, err
+}
+
+// Close 关闭 LimitElem，开启本地缓冲时会写入剩余的用户
+func (h *UserLimitHelper) Close() error {
+	if c, ok := h.LimitElem.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// key 返回 args 对应的 key，设置了 Window 时加上当前窗口的后缀，并返回窗口的结束时间
+func (h *UserLimitHelper) key(args ...any) (string, time.Time, error) {
+	return h.Window.windowKey(h.LimitElem.Key(args...), h.now)
+}
+
+// expireWindow 窗口 key 在窗口结束时过期，每个 key 成功设置一次。
+// 写入已经成功，设置失败时不返回错误，下一次写入时重试。
+func (h *UserLimitHelper) expireWindow(ctx context.Context, key string, end time.Time) {
+	ea, ok := h.LimitElem.(ExpireAter)
+	if end.IsZero() || !ok {
 		return
 	}
 
-	if h.limitStateCache == nil {
-		h.mutex.Lock()
-		defer h.mutex.Unlock()
-		if h.limitStateCache == nil {
-			h.limitStateCache = make(map[string]*limitStateCache)
-		}
+	h.mutex.Lock()
+	if h.windowExpire == nil {
+		h.windowExpire = make(map[string]time.Time)
+	}
+	_, done := h.windowExpire[key]
+	h.mutex.Unlock()
+	if done {
+		return
+	}
+
+	// key 不存在时(例如 InsertUser 还在本地缓冲中) 返回 false，下一次写入时重试
+	if ok, err := ea.ExpireAt(ctx, key, end); err != nil || !ok {
+		return
 	}
 
 	h.mutex.Lock()
 	defer h.mutex.Unlock()
-	h.limitStateCache[key] = &limitStateCache{
-		limitState:    true,
-		lastLimitTime: time.Now(),
+	now := time.Now()
+	for k, e := range h.windowExpire {
+		if now.After(e) {
+			delete(h.windowExpire, k)
+		}
 	}
+	h.windowExpire[key] = end
+}
+
+func (h *UserLimitHelper) checkLimitedCache(key string, limit int) bool {
+	if h.LimitCacheTime == 0 {
+		return false
+	}
+	_, ok := h.limitStateCache.check(key, limit)
+	return ok
+}
+
+func (h *UserLimitHelper) updateLimitedCache(key string, limit int) {
+	if h.LimitCacheTime == 0 {
+		return
+	}
+	h.limitStateCache.update(key, limit, h.LimitCacheTime, h.LimitCacheSize)
+}
+
+func (h *UserLimitHelper) clearLimitedCache(key string) {
+	h.limitStateCache.clear(key)
 }
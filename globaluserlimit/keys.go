@@ -0,0 +1,102 @@
+package globaluserlimit
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// NoExpire LimitElem.KeyTTL 的返回值，表示 key 没有设置过期时间
+const NoExpire time.Duration = -1
+
+// hashTag 返回 key 的 Redis Cluster hash tag，没有时返回空字符串
+func hashTag(key string) string {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return ""
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end <= 0 {
+		return ""
+	}
+	return key[start+1 : start+1+end]
+}
+
+// companionKey 生成与 key 位于同一个 Redis Cluster slot 的辅助 key，供多 key 的 Lua 脚本使用。
+// key 中已经有 hash tag 时直接追加后缀；否则按整个 key 计算 slot，key 中没有 '}' 时把整个 key 作为 hash tag，
+// "{key}suffix" 与 "key" 位于同一个 slot；key 中有 '}' 但没有有效的 hash tag 时(例如 "a}b"、"x{}y")
+// 不能直接加括号，改用一个 slot 相同的短 hash tag 作为前缀。
+func companionKey(key, suffix string) string {
+	if hashTag(key) != "" {
+		return key + suffix
+	}
+	if !strings.Contains(key, "}") {
+		return "{" + key + "}" + suffix
+	}
+	return "{" + slotTag(keySlot(key)) + "}" + key + suffix
+}
+
+const clusterSlots = 16384
+
+var (
+	slotTagsOnce sync.Once
+	slotTags     []string
+)
+
+// slotTag 返回计算出的 slot 等于 slot 的短 hash tag，第一次调用时枚举生成所有 slot 的 tag
+func slotTag(slot int) string {
+	slotTagsOnce.Do(func() {
+		slotTags = make([]string, clusterSlots)
+		for i, left := 0, clusterSlots; left > 0; i++ {
+			tag := strconv.FormatInt(int64(i), 36)
+			if s := keySlot(tag); slotTags[s] == "" {
+				slotTags[s] = tag
+				left--
+			}
+		}
+	})
+	return slotTags[slot]
+}
+
+// keySlot 与 Redis Cluster 一致，按 hash tag 或者整个 key 的 CRC16 计算 slot
+func keySlot(key string) int {
+	if tag := hashTag(key); tag != "" {
+		key = tag
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 Redis Cluster 使用的 CRC16-CCITT(XMODEM)
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// keyTTL 把 PTTL 的 -1、-2 转换成 NoExpire 和 0
+func keyTTL(ctx context.Context, rds redis.UniversalClient, key string) (time.Duration, error) {
+	d, err := rds.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case d == -1:
+		return NoExpire, nil
+	case d < 0:
+		return 0, nil
+	}
+	return d, nil
+}
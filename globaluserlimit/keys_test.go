@@ -0,0 +1,36 @@
+package globaluserlimit
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestHashTag(t *testing.T) {
+	assert.Equal(t, "", hashTag("item:1"))
+	assert.Equal(t, "item:1", hashTag("{item:1}:user"))
+	assert.Equal(t, "a", hashTag("x{a}{b}"))
+	assert.Equal(t, "", hashTag("x{}y"))
+	assert.Equal(t, "", hashTag("x{abc"))
+}
+
+func TestCompanionKey(t *testing.T) {
+	assert.Equal(t, "{item:1}:probe", companionKey("item:1", ":probe"))
+	assert.Equal(t, "act:{item:1}:probe", companionKey("act:{item:1}", ":probe"))
+	assert.Equal(t, "{x{abc}:probe", companionKey("x{abc", ":probe"))
+
+	// 有 '}' 但没有有效 hash tag 的 key，辅助 key 也要位于同一个 slot
+	for _, key := range []string{"item:1", "x{abc", "x{}y", "a}b", "a}b{c", "}{", "act:{item:1}"} {
+		ck := companionKey(key, ":probe")
+		assert.Assert(t, hashTag(ck) != "", "companion %q of %q has no hash tag", ck, key)
+		assert.Equal(t, keySlot(key), keySlot(ck), "companion %q of %q", ck, key)
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	assert.Equal(t, uint16(0x31C3), crc16("123456789"))
+	// 与 CLUSTER KEYSLOT 的结果一致
+	assert.Equal(t, 12182, keySlot("foo"))
+	assert.Equal(t, keySlot("bar"), keySlot("{bar}:probe"))
+	assert.Equal(t, keySlot("x{}y"), int(crc16("x{}y")%clusterSlots))
+}
@@ -0,0 +1,122 @@
+package globaluserlimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// 一致性测试见 conformance_test.go
+const (
+	rej = InsertRejected
+	adm = InsertAdmitted
+	alr = InsertAlreadyAdmitted
+)
+
+func newTestLimitElems(t *testing.T) map[string]LimitElem {
+	rds := newTestRedis(t)
+	hll, err := NewRedisHLL(rds, time.Minute, 0, 0)
+	assert.NilError(t, err)
+	hash, err := NewRedisHash(rds, time.Minute, 0, 0)
+	assert.NilError(t, err)
+	set, err := NewRedisSet(rds, time.Minute)
+	assert.NilError(t, err)
+	sliding, err := NewRedisSlidingWindow(rds, time.Minute, time.Second)
+	assert.NilError(t, err)
+	return map[string]LimitElem{
+		"RedisHLL":           &RedisHLLSingleKeyImpl{RedisHLL: *hll},
+		"RedisHash":          &RedisHashSingleKeyImpl{RedisHash: *hash},
+		"RedisSet":           &RedisSetSingleKeyImpl{RedisSet: *set},
+		"RedisSlidingWindow": &RedisSlidingWindowSingleKeyImpl{RedisSlidingWindow: *sliding},
+	}
+}
+
+func TestUserLimitHelper_LimitedCacheMember(t *testing.T) {
+	rds := newTestRedis(t)
+	hash, err := NewRedisHash(rds, time.Minute, 0, 0)
+	assert.NilError(t, err)
+	ulh := UserLimitHelper{
+		LimitElem:      &RedisHashSingleKeyImpl{RedisHash: *hash},
+		LimitCacheTime: time.Minute,
+	}
+	ctx := context.Background()
+	rds.Del(ctx, key)
+	defer rds.Del(ctx, key)
+
+	ret, err := ulh.TryInsertResult(ctx, 1, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ret, err = ulh.TryInsertResult(ctx, 1, "u2", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+
+	// 命中受限缓存后，已经计入的用户依然通过
+	assert.Assert(t, ulh.checkLimitedCache(key, 1))
+	ret, err = ulh.TryInsertResult(ctx, 1, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAlreadyAdmitted, ret)
+	ret, err = ulh.TryInsertResult(ctx, 1, "u3", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+}
+
+func TestRedisHash_InsertTime(t *testing.T) {
+	rds := newTestRedis(t)
+	hash, err := NewRedisHash(rds, time.Minute, 0, 0)
+	assert.NilError(t, err)
+	ctx := context.Background()
+	rds.Del(ctx, key)
+	defer rds.Del(ctx, key)
+
+	before := time.Now().Unix()
+	ret, err := hash.TryInsertResult(ctx, key, 10, "uid1")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ts, err := hash.InsertTime(ctx, key, "uid1")
+	assert.NilError(t, err)
+	assert.Assert(t, ts.Unix() >= before)
+
+	ttl, err := rds.TTL(ctx, key).Result()
+	assert.NilError(t, err)
+	assert.Assert(t, ttl > 0 && ttl <= time.Minute)
+
+	_, err = hash.InsertTime(ctx, key, "uid2")
+	assert.Assert(t, err != nil)
+}
+
+func TestUserLimitHelper_Introspection(t *testing.T) {
+	m, err := NewMemoryLimit(0)
+	assert.NilError(t, err)
+	ulh := UserLimitHelper{
+		LimitElem:      &MemoryLimitSingleKeyImpl{MemoryLimit: *m},
+		LimitCacheTime: time.Minute,
+	}
+	ctx := context.Background()
+
+	for _, uid := range []string{"u1", "u2", "u3"} {
+		_, err = ulh.TryInsertResult(ctx, 2, uid, key)
+		assert.NilError(t, err)
+	}
+	cnt, err := ulh.Count(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, cnt)
+	remaining, err := ulh.Remaining(ctx, 5, key)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, remaining)
+	remaining, err = ulh.Remaining(ctx, 1, key)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, remaining)
+	ttl, err := ulh.KeyTTL(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, NoExpire, ttl)
+
+	// Reset 同时清除受限缓存
+	assert.Assert(t, ulh.checkLimitedCache(key, 2))
+	assert.NilError(t, ulh.Reset(ctx, key))
+	assert.Assert(t, !ulh.checkLimitedCache(key, 2))
+	ret, err := ulh.TryInsertResult(ctx, 2, "u3", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+}
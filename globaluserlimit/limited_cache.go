@@ -0,0 +1,121 @@
+package globaluserlimit
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultLimitCacheSize 本地受限缓存默认最多保存的 key 数
+const DefaultLimitCacheSize = 10000
+
+type limitStateCache struct {
+	limitState    bool
+	lastLimitTime time.Time
+	cacheTime     time.Duration
+	limit         int // 缓存时的限量
+}
+
+func (s *limitStateCache) expired(now time.Time) bool {
+	return now.Sub(s.lastLimitTime) >= s.cacheTime
+}
+
+/*
+limitedCache 本地缓存 key 的受限状态，缓存期间不再访问 Redis。UserLimitHelper 和 RateLimitHelper 共用，
+零值可用，所有方法并发安全。
+
+缓存的状态只对相同的 limit 有效，limit 改变时(例如 UseConfiguredLimit 读取到新的限量)在访问时删除。
+过期的 key 在访问时删除，写入时每隔 sweepInterval 清理一次所有过期的 key。
+key 数达到上限时不再逐个检查过期时间(会在锁内遍历所有 key)，直接随机淘汰一个，被淘汰的 key 只是重新查询 Redis。
+*/
+type limitedCache struct {
+	mutex     sync.Mutex
+	items     map[string]*limitStateCache
+	lastSweep time.Time
+}
+
+// check key 在 limit 下是否受限，受限时同时返回缓存的剩余时间
+func (c *limitedCache) check(key string, limit int) (time.Duration, bool) {
+	limited, left, ok := c.get(key, limit)
+	if !ok || !limited {
+		return 0, false
+	}
+	return left, true
+}
+
+// get 返回缓存的状态和剩余时间，没有缓存、已经过期或者 limit 不同时 ok 为 false
+func (c *limitedCache) get(key string, limit int) (limited bool, left time.Duration, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	s, ok := c.items[key]
+	if !ok {
+		return false, 0, false
+	}
+	now := time.Now()
+	if s.expired(now) || s.limit != limit {
+		delete(c.items, key)
+		return false, 0, false
+	}
+	return s.limitState, s.cacheTime - now.Sub(s.lastLimitTime), true
+}
+
+// update 记录 key 在 limit 下受限，缓存 cacheTime，size 为最多保存的 key 数，0 时为 DefaultLimitCacheSize
+func (c *limitedCache) update(key string, limit int, cacheTime time.Duration, size int) {
+	c.set(key, true, limit, cacheTime, size)
+}
+
+// set 记录 key 在 limit 下的状态，缓存 cacheTime
+func (c *limitedCache) set(key string, limited bool, limit int, cacheTime time.Duration, size int) {
+	if cacheTime <= 0 {
+		return
+	}
+	if size <= 0 {
+		size = DefaultLimitCacheSize
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.items == nil {
+		c.items = make(map[string]*limitStateCache)
+	}
+
+	now := time.Now()
+	if _, ok := c.items[key]; !ok {
+		if now.Sub(c.lastSweep) >= sweepInterval {
+			c.sweep(now)
+		}
+		// 已满时直接淘汰，map 的遍历顺序是随机的
+		for k := range c.items {
+			if len(c.items) < size {
+				break
+			}
+			delete(c.items, k)
+		}
+	}
+	c.items[key] = &limitStateCache{
+		limitState:    limited,
+		lastLimitTime: now,
+		cacheTime:     cacheTime,
+		limit:         limit,
+	}
+}
+
+// sweep 删除所有过期的 key，调用方需要持有锁
+func (c *limitedCache) sweep(now time.Time) {
+	c.lastSweep = now
+	for k, s := range c.items {
+		if s.expired(now) {
+			delete(c.items, k)
+		}
+	}
+}
+
+func (c *limitedCache) clear(key string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.items, key)
+}
+
+func (c *limitedCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.items)
+}
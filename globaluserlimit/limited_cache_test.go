@@ -0,0 +1,194 @@
+package globaluserlimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestLimitedCache(t *testing.T) {
+	var c limitedCache
+	_, ok := c.check("k1", 1)
+	assert.Assert(t, !ok)
+
+	c.update("k1", 1, time.Minute, 0)
+	left, ok := c.check("k1", 1)
+	assert.Assert(t, ok)
+	assert.Assert(t, left > 0 && left <= time.Minute, "left %v", left)
+
+	// 未受限的状态不算命中受限缓存
+	c.set("k2", false, 1, time.Minute, 0)
+	_, ok = c.check("k2", 1)
+	assert.Assert(t, !ok)
+	limited, _, ok := c.get("k2", 1)
+	assert.Assert(t, ok && !limited)
+
+	// 过期后访问时删除
+	c.update("k3", 1, time.Millisecond, 0)
+	time.Sleep(2 * time.Millisecond)
+	_, ok = c.check("k3", 1)
+	assert.Assert(t, !ok)
+	assert.Equal(t, 2, c.len())
+
+	// 限量改变后缓存的状态作废
+	c.update("k4", 1, time.Minute, 0)
+	_, ok = c.check("k4", 2)
+	assert.Assert(t, !ok)
+	_, ok = c.check("k4", 1)
+	assert.Assert(t, !ok)
+
+	c.clear("k1")
+	_, ok = c.check("k1", 1)
+	assert.Assert(t, !ok)
+}
+
+func TestLimitedCache_Bounded(t *testing.T) {
+	var c limitedCache
+	for i := 0; i < 100; i++ {
+		c.update(fmt.Sprint("k", i), 1, time.Minute, 10)
+		assert.Assert(t, c.len() <= 10, "len %d", c.len())
+	}
+	// 最后写入的 key 总是保留
+	_, ok := c.check("k99", 1)
+	assert.Assert(t, ok)
+
+	// 达到上限时直接淘汰一个 key，不提前清理过期的 key
+	c = limitedCache{}
+	for i := 0; i < 10; i++ {
+		c.update(fmt.Sprint("e", i), 1, time.Millisecond, 10)
+	}
+	time.Sleep(2 * time.Millisecond)
+	c.update("new", 1, time.Minute, 10)
+	assert.Equal(t, 10, c.len())
+	_, ok = c.check("new", 1)
+	assert.Assert(t, ok)
+}
+
+func TestLimitedCache_Sweep(t *testing.T) {
+	var c limitedCache
+	for i := 0; i < 10; i++ {
+		c.update(fmt.Sprint("k", i), 1, time.Millisecond, 0)
+	}
+	time.Sleep(2 * time.Millisecond)
+	c.lastSweep = time.Now().Add(-sweepInterval)
+	c.update("new", 1, time.Minute, 0)
+	assert.Equal(t, 1, c.len())
+}
+
+func TestUserLimitHelper_NotLimitedCache(t *testing.T) {
+	m, err := NewMemoryLimit(0)
+	assert.NilError(t, err)
+	ulh := UserLimitHelper{
+		LimitElem:           &MemoryLimitSingleKeyImpl{MemoryLimit: *m},
+		LimitCacheTime:      time.Minute,
+		NotLimitedCacheTime: time.Minute,
+	}
+	ctx := context.Background()
+
+	limited, err := ulh.CheckUserLimit(ctx, 1, key)
+	assert.NilError(t, err)
+	assert.Assert(t, !limited)
+
+	// 其他实例写入，缓存期间仍然返回未受限
+	_, err = m.InsertUser(ctx, key, "u1")
+	assert.NilError(t, err)
+	_, err = m.InsertUser(ctx, key, "u2")
+	assert.NilError(t, err)
+	limited, err = ulh.CheckUserLimit(ctx, 1, key)
+	assert.NilError(t, err)
+	assert.Assert(t, !limited)
+
+	// TryInsert 不使用未受限的缓存，被拒绝后缓存受限
+	ret, err := ulh.TryInsertResult(ctx, 1, "u3", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+	limited, err = ulh.CheckUserLimit(ctx, 1, key)
+	assert.NilError(t, err)
+	assert.Assert(t, limited)
+}
+
+func TestUserLimitHelper_CacheByLimit(t *testing.T) {
+	m, err := NewMemoryLimit(0)
+	assert.NilError(t, err)
+	ulh := UserLimitHelper{
+		LimitElem:           &MemoryLimitSingleKeyImpl{MemoryLimit: *m},
+		LimitCacheTime:      time.Minute,
+		NotLimitedCacheTime: time.Minute,
+	}
+	ctx := context.Background()
+	_, err = m.InsertUser(ctx, key, "u1")
+	assert.NilError(t, err)
+	_, err = m.InsertUser(ctx, key, "u2")
+	assert.NilError(t, err)
+
+	// 缓存的未受限状态不用于更小的 limit
+	limited, err := ulh.CheckUserLimit(ctx, 5, key)
+	assert.NilError(t, err)
+	assert.Assert(t, !limited)
+	limited, err = ulh.CheckUserLimit(ctx, 1, key)
+	assert.NilError(t, err)
+	assert.Assert(t, limited)
+
+	// 缓存的受限状态不用于更大的 limit
+	ok, err := ulh.TryInsert(ctx, 1, "u3", key)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	ok, err = ulh.TryInsert(ctx, 5, "u3", key)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+}
+
+// TestUserLimitHelper_Concurrent 用 go test -race 运行
+func TestUserLimitHelper_Concurrent(t *testing.T) {
+	m, err := NewMemoryLimit(0)
+	assert.NilError(t, err)
+	ulh := UserLimitHelper{
+		LimitElem:           &MemoryLimitSingleKeyImpl{MemoryLimit: *m},
+		LimitCacheTime:      time.Minute,
+		LimitCacheSize:      8,
+		NotLimitedCacheTime: time.Millisecond,
+	}
+	ctx := context.Background()
+
+	const (
+		keys    = 32
+		limit   = 5
+		workers = 16
+		rounds  = 200
+	)
+	var admitted [keys]int64
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				k := i % keys
+				key := fmt.Sprint("concurrent:", k)
+				ret, err := ulh.TryInsertResult(ctx, limit, fmt.Sprint("u", w, ":", i), key)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ret == InsertAdmitted {
+					atomic.AddInt64(&admitted[k], 1)
+				}
+				if _, err := ulh.CheckUserLimit(ctx, limit, key); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	for k := range admitted {
+		assert.Equal(t, int64(limit), admitted[k], "key %d", k)
+	}
+	assert.Assert(t, ulh.limitStateCache.len() <= 8)
+}
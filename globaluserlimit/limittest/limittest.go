@@ -0,0 +1,185 @@
+/*
+Package limittest 是 globaluserlimit.LimitElem 的一致性测试，新的实现调用 Run 即可验证与已有实现的语义一致:
+
+	func TestMyLimit(t *testing.T) {
+		limittest.Run(t, func(t *testing.T) globaluserlimit.LimitElem {
+			return &MyLimitSingleKeyImpl{...}
+		})
+	}
+
+LimitElem 的 Key(args...) 需要直接返回 args[0]。每个用例使用不同的 key，不需要清理，
+实现了 MemberChecker、MultiInserter 时同时验证对应的语义。
+*/
+package limittest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/wlbgo/utils/globaluserlimit"
+	"gotest.tools/assert"
+)
+
+// Case 一组 TryInsert 的调用和期望结果
+type Case struct {
+	Name        string
+	Limit       int
+	UIDs        []string
+	Want        []globaluserlimit.InsertResult
+	WantCount   int
+	WantLimited bool // IsLimited(Limit) 的结果，用户数超过 Limit 才算受限
+}
+
+const (
+	rej = globaluserlimit.InsertRejected
+	adm = globaluserlimit.InsertAdmitted
+	alr = globaluserlimit.InsertAlreadyAdmitted
+)
+
+// Cases 所有 LimitElem 实现的结果必须一致
+var Cases = []Case{
+	{"ZeroLimit", 0, []string{"u1"}, []globaluserlimit.InsertResult{rej}, 0, false},
+	{"UnderLimit", 3, []string{"u1", "u2"}, []globaluserlimit.InsertResult{adm, adm}, 2, false},
+	{"ReachLimit", 3, []string{"u1", "u2", "u3", "u4", "u5"}, []globaluserlimit.InsertResult{adm, adm, adm, rej, rej}, 3, false},
+	{"RepeatUnderLimit", 2, []string{"u1", "u1", "u2", "u3"}, []globaluserlimit.InsertResult{adm, alr, adm, rej}, 2, false},
+	{"RepeatAtLimit", 2, []string{"u1", "u2", "u3", "u1", "u2", "u3"}, []globaluserlimit.InsertResult{adm, adm, rej, alr, alr, rej}, 2, false},
+	{"LimitOne", 1, []string{"u1", "u2", "u1"}, []globaluserlimit.InsertResult{adm, rej, alr}, 1, false},
+}
+
+// Run 对 newElem 返回的 LimitElem 运行所有一致性测试，每个子测试调用一次 newElem
+func Run(t *testing.T, newElem func(t *testing.T) globaluserlimit.LimitElem) {
+	for _, c := range Cases {
+		c := c
+		t.Run(c.Name, func(t *testing.T) {
+			runCase(t, newElem(t), c)
+		})
+	}
+	t.Run("Introspection", func(t *testing.T) {
+		runIntrospection(t, newElem(t))
+	})
+	t.Run("MemberChecker", func(t *testing.T) {
+		runMemberChecker(t, newElem(t))
+	})
+	t.Run("MultiInserter", func(t *testing.T) {
+		runMultiInserter(t, newElem(t))
+	})
+}
+
+// testKey 每次调用返回不同的 key，带有 hash tag
+func testKey(t *testing.T) string {
+	return globaluserlimit.HashTagKey(fmt.Sprintf("limittest:%s:%d", t.Name(), time.Now().UnixNano()), "")
+}
+
+func runCase(t *testing.T, elem globaluserlimit.LimitElem, c Case) {
+	ctx := context.Background()
+	k := elem.Key(testKey(t))
+
+	for i, uid := range c.UIDs {
+		ret, err := elem.TryInsertResult(ctx, k, c.Limit, uid)
+		assert.NilError(t, err)
+		assert.Equal(t, c.Want[i], ret, "TryInsert %d %s", i, uid)
+	}
+	limited, err := elem.IsLimited(ctx, k, c.Limit)
+	assert.NilError(t, err)
+	assert.Equal(t, c.WantLimited, limited)
+
+	// InsertUser 不检查限量
+	cnt, err := elem.InsertUser(ctx, k, "extra")
+	assert.NilError(t, err)
+	assert.Equal(t, c.WantCount+1, cnt)
+	limited, err = elem.IsLimited(ctx, k, c.Limit)
+	assert.NilError(t, err)
+	assert.Equal(t, c.WantCount+1 > c.Limit, limited)
+}
+
+func runIntrospection(t *testing.T, elem globaluserlimit.LimitElem) {
+	ctx := context.Background()
+	k := elem.Key(testKey(t))
+
+	cnt, err := elem.Count(ctx, k)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, cnt)
+	ttl, err := elem.KeyTTL(ctx, k)
+	assert.NilError(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+
+	for _, uid := range []string{"u1", "u2", "u1"} {
+		_, err = elem.TryInsertResult(ctx, k, 2, uid)
+		assert.NilError(t, err)
+	}
+	cnt, err = elem.Count(ctx, k)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, cnt)
+	ttl, err = elem.KeyTTL(ctx, k)
+	assert.NilError(t, err)
+	assert.Assert(t, ttl > 0 || ttl == globaluserlimit.NoExpire, "ttl %v", ttl)
+
+	assert.NilError(t, elem.Reset(ctx, k))
+	cnt, err = elem.Count(ctx, k)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, cnt)
+	ret, err := elem.TryInsertResult(ctx, k, 1, "u3")
+	assert.NilError(t, err)
+	assert.Equal(t, adm, ret)
+}
+
+func runMemberChecker(t *testing.T, elem globaluserlimit.LimitElem) {
+	mc, ok := elem.(globaluserlimit.MemberChecker)
+	if !ok {
+		t.Skip("not a MemberChecker")
+	}
+	ctx := context.Background()
+	k := elem.Key(testKey(t))
+
+	in, err := mc.Contains(ctx, k, "u1")
+	assert.NilError(t, err)
+	assert.Assert(t, !in)
+	// TryInsert 与 TryInsertResult 一致，通过时返回 true
+	inserted, err := elem.TryInsert(ctx, k, 1, "u1")
+	assert.NilError(t, err)
+	assert.Assert(t, inserted)
+	inserted, err = elem.TryInsert(ctx, k, 1, "u2")
+	assert.NilError(t, err)
+	assert.Assert(t, !inserted)
+	inserted, err = elem.TryInsert(ctx, k, 1, "u1")
+	assert.NilError(t, err)
+	assert.Assert(t, inserted)
+	in, err = mc.Contains(ctx, k, "u1")
+	assert.NilError(t, err)
+	assert.Assert(t, in)
+	in, err = mc.Contains(ctx, k, "u2")
+	assert.NilError(t, err)
+	assert.Assert(t, !in)
+}
+
+func runMultiInserter(t *testing.T, elem globaluserlimit.LimitElem) {
+	mi, ok := elem.(globaluserlimit.MultiInserter)
+	if !ok {
+		t.Skip("not a MultiInserter")
+	}
+	ctx := context.Background()
+	base := testKey(t)
+	k1, k2 := elem.Key(base+"a"), elem.Key(base+"b")
+
+	ret, err := mi.TryInsertAll(ctx, "u1", []string{k1, k2}, []int{2, 1})
+	assert.NilError(t, err)
+	assert.Assert(t, ret.Admitted())
+	assert.DeepEqual(t, []globaluserlimit.InsertResult{adm, adm}, ret.Results)
+
+	// 第二条规则拒绝，第一条不变
+	ret, err = mi.TryInsertAll(ctx, "u2", []string{k1, k2}, []int{2, 1})
+	assert.NilError(t, err)
+	assert.Equal(t, 1, ret.Rejected)
+	limited, err := elem.IsLimited(ctx, k1, 1)
+	assert.NilError(t, err)
+	assert.Assert(t, !limited)
+
+	ret, err = mi.TryInsertAll(ctx, "u1", []string{k1, k2}, []int{2, 1})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []globaluserlimit.InsertResult{alr, alr}, ret.Results)
+
+	_, err = mi.TryInsertAll(ctx, "u1", []string{k1, "limittest:no_tag"}, []int{2, 1})
+	assert.Equal(t, globaluserlimit.ErrCrossSlot, err)
+}
@@ -0,0 +1,134 @@
+package globaluserlimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// allocFlight 同一个 key 同时只有一个请求访问 Redis，其他请求等待它完成。嵌入到 localAlloc 的 entry 中
+type allocFlight struct {
+	refresh chan struct{} // 正在访问 Redis 时非 nil，完成后关闭
+}
+
+// busy 是否正在访问 Redis，调用方需要持有锁
+func (f *allocFlight) busy() bool {
+	return f.refresh != nil
+}
+
+// begin 开始访问 Redis，调用方需要持有锁
+func (f *allocFlight) begin() {
+	f.refresh = make(chan struct{})
+}
+
+// done 结束访问 Redis，唤醒等待的请求，调用方需要持有锁
+func (f *allocFlight) done() {
+	close(f.refresh)
+	f.refresh = nil
+}
+
+// refreshed 访问 Redis 完成时关闭，调用方需要持有锁
+func (f *allocFlight) refreshed() <-chan struct{} {
+	return f.refresh
+}
+
+type allocEntry interface {
+	busy() bool
+	begin()
+	done()
+	refreshed() <-chan struct{}
+}
+
+/*
+localAlloc RedisStock 和 RedisLease 共用的本地预分配: 按 key 保存本实例的 entry，所有 entry 共用一把锁，
+start 之后后台每隔 interval 调用一次 flush(ctx, false) 归还到期的预分配，close 停止后台归还后调用 flush(ctx, true)。
+需要通过 newLocalAlloc 创建。
+*/
+type localAlloc[E allocEntry] struct {
+	mutex   sync.Mutex
+	entries map[string]E
+	flush   func(ctx context.Context, all bool) error
+
+	stopChan chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+}
+
+func newLocalAlloc[E allocEntry](flush func(ctx context.Context, all bool) error) *localAlloc[E] {
+	return &localAlloc[E]{
+		entries:  make(map[string]E),
+		flush:    flush,
+		stopChan: make(chan struct{}),
+	}
+}
+
+// start 启动后台归还，flush 用到的字段需要在这之前设置好
+func (a *localAlloc[E]) start(interval time.Duration) {
+	a.wg.Add(1)
+	go a.worker(interval)
+}
+
+// wait 等待 e 结束访问 Redis，调用时和返回时(包括返回错误时)都持有锁
+func (a *localAlloc[E]) wait(ctx context.Context, e E) error {
+	ch := e.refreshed()
+	a.mutex.Unlock()
+	defer a.mutex.Lock()
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// release 在锁内对每个没有访问 Redis 的 entry 调用 pick，pick 可以删除 entry，返回非 nil 时标记 entry 为正在访问，
+// 之后在锁外逐个执行，执行的函数需要调用 entry 的 done。返回第一个错误
+func (a *localAlloc[E]) release(ctx context.Context, pick func(key string, e E) func(context.Context) error) error {
+	var runs []func(context.Context) error
+	a.mutex.Lock()
+	for key, e := range a.entries {
+		if e.busy() {
+			continue
+		}
+		if run := pick(key, e); run != nil {
+			e.begin()
+			runs = append(runs, run)
+		}
+	}
+	a.mutex.Unlock()
+
+	var firstErr error
+	for _, run := range runs {
+		if err := run(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (a *localAlloc[E]) worker(interval time.Duration) {
+	defer a.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			_ = a.flush(ctx, false)
+			cancel()
+		case <-a.stopChan:
+			return
+		}
+	}
+}
+
+// close 停止后台归还，再归还所有的预分配
+func (a *localAlloc[E]) close() error {
+	a.stopOnce.Do(func() {
+		close(a.stopChan)
+	})
+	a.wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return a.flush(ctx, true)
+}
@@ -0,0 +1,261 @@
+package globaluserlimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+var (
+	_ LimitElem     = &MemoryLimitSingleKeyImpl{}
+	_ MemberChecker = &MemoryLimit{}
+	_ MultiInserter = &MemoryLimit{}
+	_ ExpireAter    = &MemoryLimit{}
+)
+
+/*
+MemoryLimit 进程内的精确计数，语义与 RedisHash、RedisSet 一致，用于测试和单机部署。
+
+TTL 与 Redis 的 EXPIRE 一致: 每次计入用户后重新计算过期时间，被拒绝不会延长。
+过期的 key 在访问时删除，写入时每隔 sweepInterval 清理一次所有过期的 key。
+Clock 可以替换，用于在测试中控制时间。需要通过 NewMemoryLimit 创建。
+*/
+type MemoryLimit struct {
+	TTL   time.Duration
+	Clock func() time.Time // 默认 time.Now
+
+	store *memoryStore
+}
+
+type MemoryLimitSingleKeyImpl struct {
+	MemoryLimit
+}
+
+func (r *MemoryLimitSingleKeyImpl) Key(args ...any) string {
+	return args[0].(string)
+}
+
+type memoryKey struct {
+	users    map[string]time.Time // 用户和计入时间
+	expireAt time.Time            // 零值表示不过期
+}
+
+type memoryStore struct {
+	mutex     sync.Mutex
+	keys      map[string]*memoryKey
+	lastSweep time.Time
+}
+
+const sweepInterval = time.Minute
+
+func NewMemoryLimit(ttl time.Duration) (*MemoryLimit, error) {
+	if ttl < 0 {
+		return nil, ErrBadConfig
+	}
+	return &MemoryLimit{
+		TTL:   ttl,
+		store: &memoryStore{keys: make(map[string]*memoryKey)},
+	}, nil
+}
+
+func (s *MemoryLimit) now() time.Time {
+	if s.Clock != nil {
+		return s.Clock()
+	}
+	return time.Now()
+}
+
+// get 返回未过期的 key，create 为 true 时不存在则创建，调用方需要持有锁
+func (s *MemoryLimit) get(key string, now time.Time, create bool) *memoryKey {
+	k, ok := s.store.keys[key]
+	if ok && !k.expireAt.IsZero() && !now.Before(k.expireAt) {
+		delete(s.store.keys, key)
+		k, ok = nil, false
+	}
+	if !ok && create {
+		k = &memoryKey{users: make(map[string]time.Time)}
+		s.store.keys[key] = k
+	}
+	return k
+}
+
+// touch 计入用户后刷新过期时间并定期清理，调用方需要持有锁
+func (s *MemoryLimit) touch(k *memoryKey, now time.Time) {
+	if s.TTL > 0 {
+		k.expireAt = now.Add(s.TTL)
+	}
+	if now.Sub(s.store.lastSweep) < sweepInterval {
+		return
+	}
+	s.store.lastSweep = now
+	for key, k := range s.store.keys {
+		if !k.expireAt.IsZero() && !now.Before(k.expireAt) {
+			delete(s.store.keys, key)
+		}
+	}
+}
+
+func (s *MemoryLimit) TryInsert(ctx context.Context, key string, limit int, uid string) (bool, error) {
+	ret, err := s.TryInsertResult(ctx, key, limit, uid)
+	return ret.Admitted(), err
+}
+
+func (s *MemoryLimit) TryInsertResult(ctx context.Context, key string, limit int, uid string) (InsertResult, error) {
+	if limit <= 0 {
+		return InsertRejected, nil
+	}
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	now := s.now()
+	k := s.get(key, now, true)
+	ret := s.check(k, limit, uid)
+	if ret == InsertRejected {
+		return ret, nil
+	}
+	if ret == InsertAdmitted {
+		k.users[uid] = now
+	}
+	s.touch(k, now)
+	return ret, nil
+}
+
+func (s *MemoryLimit) check(k *memoryKey, limit int, uid string) InsertResult {
+	if _, ok := k.users[uid]; ok {
+		return InsertAlreadyAdmitted
+	}
+	if len(k.users) >= limit {
+		return InsertRejected
+	}
+	return InsertAdmitted
+}
+
+// InsertUser 不检查限量直接插入，返回当前用户数
+func (s *MemoryLimit) InsertUser(ctx context.Context, key, uid string) (int, error) {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	now := s.now()
+	k := s.get(key, now, true)
+	if _, ok := k.users[uid]; !ok {
+		k.users[uid] = now
+	}
+	s.touch(k, now)
+	return len(k.users), nil
+}
+
+// IsLimited 与 RedisHLL 一致，用户数超过 limit 时返回 true
+func (s *MemoryLimit) IsLimited(ctx context.Context, key string, limit int) (bool, error) {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	k := s.get(key, s.now(), false)
+	return k != nil && len(k.users) > limit, nil
+}
+
+func (s *MemoryLimit) Count(ctx context.Context, key string) (int, error) {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	k := s.get(key, s.now(), false)
+	if k == nil {
+		return 0, nil
+	}
+	return len(k.users), nil
+}
+
+func (s *MemoryLimit) KeyTTL(ctx context.Context, key string) (time.Duration, error) {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	now := s.now()
+	k := s.get(key, now, false)
+	switch {
+	case k == nil:
+		return 0, nil
+	case k.expireAt.IsZero():
+		return NoExpire, nil
+	}
+	return k.expireAt.Sub(now), nil
+}
+
+func (s *MemoryLimit) Reset(ctx context.Context, key string) error {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	delete(s.store.keys, key)
+	return nil
+}
+
+// TryInsertAll 与 Redis 的实现一致，多个 key 也需要有相同的 hash tag
+func (s *MemoryLimit) TryInsertAll(ctx context.Context, uid string, keys []string, limits []int) (MultiInsertResult, error) {
+	i, err := checkMultiKeys(keys, limits)
+	if err != nil {
+		return MultiInsertResult{Rejected: 0}, err
+	}
+	if i >= 0 {
+		return MultiInsertResult{Rejected: i}, nil
+	}
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	now := s.now()
+	results := make([]InsertResult, len(keys))
+	for i, key := range keys {
+		k := s.get(key, now, false)
+		if k == nil {
+			k = &memoryKey{}
+		}
+		if results[i] = s.check(k, limits[i], uid); results[i] == InsertRejected {
+			return MultiInsertResult{Rejected: i}, nil
+		}
+	}
+	for _, key := range keys {
+		k := s.get(key, now, true)
+		if _, ok := k.users[uid]; !ok {
+			k.users[uid] = now
+		}
+		s.touch(k, now)
+	}
+	return MultiInsertResult{Rejected: -1, Results: results}, nil
+}
+
+// Contains 用户是否已经计入
+func (s *MemoryLimit) Contains(ctx context.Context, key, uid string) (bool, error) {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	k := s.get(key, s.now(), false)
+	if k == nil {
+		return false, nil
+	}
+	_, ok := k.users[uid]
+	return ok, nil
+}
+
+// Remove 移除用户并释放名额，返回用户之前是否存在
+func (s *MemoryLimit) Remove(ctx context.Context, key, uid string) (bool, error) {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	k := s.get(key, s.now(), false)
+	if k == nil {
+		return false, nil
+	}
+	_, ok := k.users[uid]
+	delete(k.users, uid)
+	return ok, nil
+}
+
+// ExpireAt key 在 tm 过期，key 不存在时返回 false
+func (s *MemoryLimit) ExpireAt(ctx context.Context, key string, tm time.Time) (bool, error) {
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+
+	k := s.get(key, s.now(), false)
+	if k == nil {
+		return false, nil
+	}
+	k.expireAt = tm
+	return true, nil
+}
@@ -0,0 +1,76 @@
+package globaluserlimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestMemoryLimit_TTL(t *testing.T) {
+	m, err := NewMemoryLimit(time.Minute)
+	assert.NilError(t, err)
+	now := time.Now()
+	m.Clock = func() time.Time { return now }
+	ulh := UserLimitHelper{LimitElem: &MemoryLimitSingleKeyImpl{MemoryLimit: *m}}
+	ctx := context.Background()
+
+	ret, err := ulh.TryInsertResult(ctx, 1, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	// 被拒绝不延长过期时间，已经计入会延长
+	now = now.Add(40 * time.Second)
+	ret, err = ulh.TryInsertResult(ctx, 1, "u2", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+	now = now.Add(30 * time.Second)
+	ret, err = ulh.TryInsertResult(ctx, 1, "u2", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	now = now.Add(50 * time.Second)
+	ret, err = ulh.TryInsertResult(ctx, 1, "u2", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAlreadyAdmitted, ret)
+	now = now.Add(59 * time.Second)
+	in, err := m.Contains(ctx, key, "u2")
+	assert.NilError(t, err)
+	assert.Assert(t, in)
+	now = now.Add(time.Second)
+	in, err = m.Contains(ctx, key, "u2")
+	assert.NilError(t, err)
+	assert.Assert(t, !in)
+}
+
+func TestMemoryLimit_Window(t *testing.T) {
+	m, err := NewMemoryLimit(0)
+	assert.NilError(t, err)
+	now := time.Date(2024, 4, 3, 12, 0, 0, 0, time.UTC)
+	m.Clock = func() time.Time { return now }
+	ulh := UserLimitHelper{
+		LimitElem: &MemoryLimitSingleKeyImpl{MemoryLimit: *m},
+		Window:    Window{Type: WindowDaily, Location: time.UTC},
+		now:       func() time.Time { return now },
+	}
+	ctx := context.Background()
+
+	ret, err := ulh.TryInsertResult(ctx, 1, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	cnt, err := m.InsertUser(ctx, key+":d20240403", "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, 2, cnt)
+
+	// 窗口结束时 key 过期
+	now = time.Date(2024, 4, 4, 0, 0, 0, 0, time.UTC)
+	limited, err := m.IsLimited(ctx, key+":d20240403", 0)
+	assert.NilError(t, err)
+	assert.Assert(t, !limited)
+	ret, err = ulh.TryInsertResult(ctx, 1, "u2", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	removed, err := m.Remove(ctx, key+":d20240404", "u2")
+	assert.NilError(t, err)
+	assert.Assert(t, removed)
+}
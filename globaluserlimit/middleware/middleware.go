@@ -0,0 +1,223 @@
+/*
+Package middleware 把 globaluserlimit.UserLimitHelper 包装为 net/http 中间件和 gRPC 风格的一元拦截器。
+
+每个请求从 UID 取得用户，从 Args 取得 Helper 的 key 参数，调用 TryInsert，被拒绝时 HTTP 返回 429，
+拦截器返回 RejectedError。为了不依赖 grpc，拦截器的签名使用本包的类型，接入时包一层:
+
+	limit := middleware.Unary{...}
+	grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		return limit.Intercept(ctx, req, info.FullMethod, middleware.UnaryHandler(handler))
+	})
+
+Rejected 可以返回 status.Error(codes.ResourceExhausted, ...)。
+*/
+package middleware
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/wlbgo/utils/globaluserlimit"
+)
+
+// ErrNoUID UID 返回空字符串
+var ErrNoUID = errors.New("no uid")
+
+const (
+	HeaderRemaining  = "X-RateLimit-Remaining"
+	HeaderRetryAfter = "Retry-After"
+)
+
+// Result 一次检查的结果
+type Result struct {
+	Insert     globaluserlimit.InsertResult
+	Remaining  int           // 还可以计入的新用户数，SkipRemaining 或者查询失败时为 -1
+	RetryAfter time.Duration // 被拒绝时到当前 key 过期的时间，未知时为 0
+}
+
+// Limiter HTTP 和拦截器共用的检查逻辑
+type Limiter struct {
+	Helper *globaluserlimit.UserLimitHelper
+	Limit  int // 可以是 globaluserlimit.UseConfiguredLimit
+
+	// SkipRemaining 不查询剩余名额。查询需要额外访问一次 Redis，写入成功后才查询
+	SkipRemaining bool
+}
+
+// Check 尝试计入用户，错误时 Result 没有意义，没有设置 Helper 时返回 globaluserlimit.ErrBadConfig
+func (l *Limiter) Check(ctx context.Context, uid string, args ...any) (Result, error) {
+	if l.Helper == nil {
+		return Result{}, globaluserlimit.ErrBadConfig
+	}
+	if uid == "" {
+		return Result{}, ErrNoUID
+	}
+	ret, err := l.Helper.TryInsertResult(ctx, l.Limit, uid, args...)
+	if err != nil {
+		return Result{}, err
+	}
+	res := Result{Insert: ret, Remaining: -1}
+	if !ret.Admitted() {
+		res.Remaining = 0
+		res.RetryAfter = l.retryAfter(ctx, args...)
+		return res, nil
+	}
+	if !l.SkipRemaining {
+		if n, err := l.Helper.Remaining(ctx, l.Limit, args...); err == nil {
+			res.Remaining = n
+		}
+	}
+	return res, nil
+}
+
+// retryAfter 设置了 Window 时为窗口的结束时间，否则为 key 的过期时间
+func (l *Limiter) retryAfter(ctx context.Context, args ...any) time.Duration {
+	if l.Helper.Window.Type != globaluserlimit.WindowNone {
+		now := time.Now()
+		if _, end, err := l.Helper.Window.Bounds(now); err == nil {
+			return end.Sub(now)
+		}
+		return 0
+	}
+	ttl, err := l.Helper.KeyTTL(ctx, args...)
+	if err != nil || ttl < 0 {
+		return 0
+	}
+	return ttl
+}
+
+// HTTP net/http 中间件，Args、Rejected、Error 为 nil 时使用默认实现。
+// UID 和 Helper 必须设置，没有设置时所有请求按 globaluserlimit.ErrBadConfig 出错处理
+type HTTP struct {
+	Limiter
+
+	Args func(r *http.Request) []any  // Helper 的 key 参数
+	UID  func(r *http.Request) string // 用户 ID，例如 FromHeader("X-User-Id")
+
+	// Rejected 被拒绝时的响应，默认 429。调用前已经设置了 Header
+	Rejected func(w http.ResponseWriter, r *http.Request, res Result)
+	// Error 出错时的响应，默认 ErrNoUID 返回 400，其他返回 503
+	Error func(w http.ResponseWriter, r *http.Request, err error)
+}
+
+// Handler 返回包装 next 的 http.Handler
+func (m *HTTP) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var args []any
+		if m.Args != nil {
+			args = m.Args(r)
+		}
+		var res Result
+		var err error
+		if m.UID == nil {
+			err = globaluserlimit.ErrBadConfig
+		} else {
+			res, err = m.Check(r.Context(), m.UID(r), args...)
+		}
+		if err != nil {
+			if m.Error != nil {
+				m.Error(w, r, err)
+			} else {
+				defaultError(w, err)
+			}
+			return
+		}
+
+		if res.Remaining >= 0 {
+			w.Header().Set(HeaderRemaining, strconv.Itoa(res.Remaining))
+		}
+		if res.Insert.Admitted() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if res.RetryAfter > 0 {
+			w.Header().Set(HeaderRetryAfter, strconv.Itoa(int(math.Ceil(res.RetryAfter.Seconds()))))
+		}
+		if m.Rejected != nil {
+			m.Rejected(w, r, res)
+		} else {
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		}
+	})
+}
+
+func defaultError(w http.ResponseWriter, err error) {
+	if errors.Is(err, ErrNoUID) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+}
+
+// FromHeader 从请求头读取
+func FromHeader(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// FromQuery 从 URL 参数读取
+func FromQuery(name string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(name)
+	}
+}
+
+// StaticArgs 所有请求使用相同的 key 参数
+func StaticArgs(args ...any) func(r *http.Request) []any {
+	return func(r *http.Request) []any {
+		return args
+	}
+}
+
+// UnaryHandler 与 grpc.UnaryHandler 相同
+type UnaryHandler func(ctx context.Context, req any) (any, error)
+
+// RejectedError Unary 默认的拒绝错误
+type RejectedError struct {
+	Method string
+	Result Result
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("%s: user limit exceeded, retry after %v", e.Method, e.Result.RetryAfter)
+}
+
+// Unary gRPC 风格的一元拦截器，Args、Rejected 为 nil 时使用默认实现。
+// UID 和 Helper 必须设置，没有设置时返回 globaluserlimit.ErrBadConfig
+type Unary struct {
+	Limiter
+
+	Args func(ctx context.Context, method string, req any) []any
+	UID  func(ctx context.Context, req any) string
+
+	// Rejected 被拒绝时返回的错误，默认 *RejectedError
+	Rejected func(ctx context.Context, method string, res Result) error
+}
+
+// Intercept 检查通过后调用 handler，出错时直接返回错误
+func (u *Unary) Intercept(ctx context.Context, req any, method string, handler UnaryHandler) (any, error) {
+	var args []any
+	if u.Args != nil {
+		args = u.Args(ctx, method, req)
+	}
+	if u.UID == nil {
+		return nil, globaluserlimit.ErrBadConfig
+	}
+	res, err := u.Check(ctx, u.UID(ctx, req), args...)
+	if err != nil {
+		return nil, err
+	}
+	if res.Insert.Admitted() {
+		return handler(ctx, req)
+	}
+	if u.Rejected != nil {
+		return nil, u.Rejected(ctx, method, res)
+	}
+	return nil, &RejectedError{Method: method, Result: res}
+}
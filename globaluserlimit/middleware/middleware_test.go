@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/wlbgo/utils/globaluserlimit"
+	"gotest.tools/assert"
+)
+
+func newHelper(t *testing.T, window globaluserlimit.Window) *globaluserlimit.UserLimitHelper {
+	m, err := globaluserlimit.NewMemoryLimit(time.Hour)
+	assert.NilError(t, err)
+	return &globaluserlimit.UserLimitHelper{
+		LimitElem: &globaluserlimit.MemoryLimitSingleKeyImpl{MemoryLimit: *m},
+		Window:    window,
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	m := &HTTP{
+		Limiter: Limiter{Helper: newHelper(t, globaluserlimit.Window{}), Limit: 2},
+		Args:    StaticArgs("mw:http"),
+		UID:     FromHeader("X-User-Id"),
+	}
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	do := func(uid string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		if uid != "" {
+			r.Header.Set("X-User-Id", uid)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	cases := []struct {
+		uid        string
+		code       int
+		remaining  string
+		retryAfter bool
+	}{
+		{"u1", http.StatusOK, "1", false},
+		{"u1", http.StatusOK, "1", false},
+		{"u2", http.StatusOK, "0", false},
+		{"u3", http.StatusTooManyRequests, "0", true},
+		{"u2", http.StatusOK, "0", false},
+		{"", http.StatusBadRequest, "", false},
+	}
+	for i, c := range cases {
+		w := do(c.uid)
+		assert.Equal(t, c.code, w.Code, "case %d", i)
+		assert.Equal(t, c.remaining, w.Header().Get(HeaderRemaining), "case %d", i)
+		if c.retryAfter {
+			sec, err := strconv.Atoi(w.Header().Get(HeaderRetryAfter))
+			assert.NilError(t, err)
+			assert.Assert(t, sec > 0 && sec <= 3600, "retry after %d", sec)
+		} else {
+			assert.Equal(t, "", w.Header().Get(HeaderRetryAfter), "case %d", i)
+		}
+	}
+}
+
+func TestHTTP_Window(t *testing.T) {
+	m := &HTTP{
+		Limiter: Limiter{
+			Helper:        newHelper(t, globaluserlimit.Window{Type: globaluserlimit.WindowDaily, Location: time.UTC}),
+			Limit:         0,
+			SkipRemaining: true,
+		},
+		Args: func(r *http.Request) []any { return []any{"mw:" + r.URL.Path} },
+		UID:  FromQuery("uid"),
+		Rejected: func(w http.ResponseWriter, r *http.Request, res Result) {
+			w.WriteHeader(http.StatusForbidden)
+		},
+	}
+	h := m.Handler(http.NotFoundHandler())
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/item?uid=u1", nil))
+
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "0", w.Header().Get(HeaderRemaining))
+	now := time.Now().UTC()
+	end := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	sec, err := strconv.Atoi(w.Header().Get(HeaderRetryAfter))
+	assert.NilError(t, err)
+	assert.Assert(t, sec > 0 && sec <= int(end.Sub(now).Seconds())+1, "retry after %d", sec)
+}
+
+func TestHTTP_Error(t *testing.T) {
+	var got error
+	m := &HTTP{
+		Limiter: Limiter{Helper: newHelper(t, globaluserlimit.Window{}), Limit: globaluserlimit.UseConfiguredLimit},
+		Args:    StaticArgs("mw:error"),
+		UID:     FromHeader("X-User-Id"),
+		Error: func(w http.ResponseWriter, r *http.Request, err error) {
+			got = err
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-User-Id", "u1")
+	w := httptest.NewRecorder()
+	m.Handler(http.NotFoundHandler()).ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.Equal(t, globaluserlimit.ErrBadConfig, got)
+}
+
+type uidKey struct{}
+
+func TestUnary(t *testing.T) {
+	u := &Unary{
+		Limiter: Limiter{Helper: newHelper(t, globaluserlimit.Window{}), Limit: 1},
+		Args: func(ctx context.Context, method string, req any) []any {
+			return []any{"mw:" + method}
+		},
+		UID: func(ctx context.Context, req any) string {
+			uid, _ := ctx.Value(uidKey{}).(string)
+			return uid
+		},
+	}
+	calls := 0
+	handler := func(ctx context.Context, req any) (any, error) {
+		calls++
+		return req, nil
+	}
+	ctx := context.Background()
+
+	resp, err := u.Intercept(context.WithValue(ctx, uidKey{}, "u1"), "req", "/svc/Get", handler)
+	assert.NilError(t, err)
+	assert.Equal(t, "req", resp)
+
+	_, err = u.Intercept(context.WithValue(ctx, uidKey{}, "u2"), "req", "/svc/Get", handler)
+	var rejected *RejectedError
+	assert.Assert(t, errors.As(err, &rejected), "err %v", err)
+	assert.Equal(t, "/svc/Get", rejected.Method)
+	assert.Equal(t, globaluserlimit.InsertRejected, rejected.Result.Insert)
+	assert.Equal(t, 1, calls)
+
+	// 不同的方法分别限量
+	_, err = u.Intercept(context.WithValue(ctx, uidKey{}, "u2"), "req", "/svc/List", handler)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, calls)
+
+	_, err = u.Intercept(ctx, "req", "/svc/Get", handler)
+	assert.Equal(t, ErrNoUID, err)
+
+	errExhausted := errors.New("resource exhausted")
+	u.Rejected = func(ctx context.Context, method string, res Result) error {
+		return errExhausted
+	}
+	_, err = u.Intercept(context.WithValue(ctx, uidKey{}, "u3"), "req", "/svc/Get", handler)
+	assert.Equal(t, errExhausted, err)
+}
+
+func TestZeroValue(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("next must not be called")
+	})
+	w := httptest.NewRecorder()
+	(&HTTP{}).Handler(next).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	// 只设置了 UID，没有设置 Helper
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("X-User-Id", "u1")
+	(&HTTP{UID: FromHeader("X-User-Id")}).Handler(next).ServeHTTP(w, r)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+	handler := func(ctx context.Context, req any) (any, error) {
+		t.Error("handler must not be called")
+		return nil, nil
+	}
+	_, err := (&Unary{}).Intercept(context.Background(), "req", "/svc/Get", handler)
+	assert.Equal(t, globaluserlimit.ErrBadConfig, err)
+	_, err = (&Unary{UID: func(ctx context.Context, req any) string { return "u1" }}).Intercept(context.Background(), "req", "/svc/Get", handler)
+	assert.Equal(t, globaluserlimit.ErrBadConfig, err)
+}
@@ -0,0 +1,207 @@
+package globaluserlimit
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var ErrCrossSlot = errors.New("keys are not in the same hash slot")
+
+// HashTagKey 给 key 加上 Redis Cluster hash tag，TryInsertAll 的所有 key 需要使用相同的 tag，例如
+// HashTagKey("item:1", "global")、HashTagKey("item:1", "region:cn")
+func HashTagKey(tag, key string) string {
+	return "{" + tag + "}" + key
+}
+
+// Rule TryInsertAll 的一条规则，Args 用于 LimitElem.Key
+type Rule struct {
+	Limit int
+	Args  []any
+}
+
+// MultiInsertResult TryInsertAll 的结果，出错时 Rejected 为 0，Admitted 返回 false
+type MultiInsertResult struct {
+	Rejected int            // 拒绝的规则下标，-1 表示全部通过
+	Results  []InsertResult // 全部通过时每条规则的结果，被拒绝时为 nil
+}
+
+// Admitted 所有规则都通过
+func (r MultiInsertResult) Admitted() bool {
+	return r.Rejected < 0
+}
+
+// MultiInserter 支持多个 key 原子检查并插入的 LimitElem
+type MultiInserter interface {
+	// TryInsertAll 在一个脚本中检查所有 key，全部通过才插入，否则不做任何修改。
+	// 多个 key 需要有相同的 hash tag，否则返回 ErrCrossSlot。
+	TryInsertAll(ctx context.Context, uid string, keys []string, limits []int) (MultiInsertResult, error)
+}
+
+var (
+	_ MultiInserter = &RedisHLL{}
+	_ MultiInserter = &RedisHash{}
+	_ MultiInserter = &RedisSet{}
+)
+
+// checkMultiKeys 检查 key 是否位于同一个 slot，返回第一个 limit <= 0 的下标，没有时返回 -1
+func checkMultiKeys(keys []string, limits []int) (int, error) {
+	if len(keys) != len(limits) {
+		return -1, ErrBadConfig
+	}
+	if len(keys) > 1 {
+		tag := hashTag(keys[0])
+		for _, k := range keys {
+			if tag == "" || hashTag(k) != tag {
+				return -1, ErrCrossSlot
+			}
+		}
+	}
+	for i, limit := range limits {
+		if limit <= 0 {
+			return i, nil
+		}
+	}
+	return -1, nil
+}
+
+// parseMultiResult 脚本返回 {0, 每个 key 的结果...} 表示全部通过，{i} 表示第 i 个 key(从 1 开始)被拒绝
+func parseMultiResult(ret []interface{}) MultiInsertResult {
+	if i := ret[0].(int64); i > 0 {
+		return MultiInsertResult{Rejected: int(i) - 1}
+	}
+	results := make([]InsertResult, 0, len(ret)-1)
+	for _, v := range ret[1:] {
+		results = append(results, InsertResult(v.(int64)))
+	}
+	return MultiInsertResult{Rejected: -1, Results: results}
+}
+
+// 每个 key 一对 KEYS: key, probe；ARGV: uid, ttl, 每个 key 的 limit
+const hllTryInsertAllLua = `
+local n = #KEYS / 2
+local ret = {}
+for i = 1, n do
+	local k, p = KEYS[2*i-1], KEYS[2*i]
+	local c = redis.call('PFCOUNT', k)
+	redis.call('DEL', p)
+	redis.call('PFMERGE', p, k)
+	redis.call('PFADD', p, ARGV[1])
+	local grown = redis.call('PFCOUNT', p) > c
+	redis.call('DEL', p)
+	if not grown then
+		ret[i] = 2
+	elseif c >= tonumber(ARGV[2+i]) then
+		return {i}
+	else
+		ret[i] = 1
+	end
+end
+for i = 1, n do
+	local k = KEYS[2*i-1]
+	if ret[i] == 1 then redis.call('PFADD', k, ARGV[1]) end
+	if tonumber(ARGV[2]) > 0 then redis.call('EXPIRE', k, ARGV[2]) end
+end
+return {0, unpack(ret)}`
+
+func (s *RedisHLL) TryInsertAll(ctx context.Context, uid string, keys []string, limits []int) (MultiInsertResult, error) {
+	i, err := checkMultiKeys(keys, limits)
+	if err != nil {
+		return MultiInsertResult{Rejected: 0}, err
+	}
+	if i >= 0 {
+		return MultiInsertResult{Rejected: i}, nil
+	}
+	scriptKeys := make([]string, 0, 2*len(keys))
+	args := []interface{}{uid, ttlSeconds(s.TTL)}
+	for i, k := range keys {
+		scriptKeys = append(scriptKeys, k, companionKey(k, ":probe"))
+		args = append(args, limits[i])
+	}
+	ret, err := hllTryInsertAllScript.Run(ctx, s.Rds, scriptKeys, args...).Slice()
+	if err != nil {
+		return MultiInsertResult{Rejected: 0}, err
+	}
+	return parseMultiResult(ret), nil
+}
+
+// 每个 key 一对 KEYS: 用户 hash, 预留 zset；ARGV: uid, 计入时间戳(秒), ttl, 当前时间(毫秒), 每个 key 的 limit
+const hashTryInsertAllLua = hashLuaPrelude + `
+local n = #KEYS / 2
+local ret = {}
+for i = 1, n do
+	local h, z = KEYS[2*i-1], KEYS[2*i]
+	reclaim(ARGV[4], h, z)
+	if redis.call('HEXISTS', h, ARGV[1]) == 1 then
+		ret[i] = 2
+	elseif redis.call('HLEN', h) >= tonumber(ARGV[4+i]) then
+		return {i}
+	else
+		ret[i] = 1
+	end
+end
+for i = 1, n do
+	local h, z = KEYS[2*i-1], KEYS[2*i]
+	if ret[i] == 1 then redis.call('HSET', h, ARGV[1], ARGV[2]) end
+	expire(ARGV[3], h, z)
+end
+return {0, unpack(ret)}`
+
+func (s *RedisHash) TryInsertAll(ctx context.Context, uid string, keys []string, limits []int) (MultiInsertResult, error) {
+	i, err := checkMultiKeys(keys, limits)
+	if err != nil {
+		return MultiInsertResult{Rejected: 0}, err
+	}
+	if i >= 0 {
+		return MultiInsertResult{Rejected: i}, nil
+	}
+	now := time.Now()
+	scriptKeys := make([]string, 0, 2*len(keys))
+	args := []interface{}{uid, now.Unix(), ttlSeconds(s.TTL), now.UnixMilli()}
+	for i, k := range keys {
+		scriptKeys = append(scriptKeys, k, reservationKey(k))
+		args = append(args, limits[i])
+	}
+	ret, err := hashTryInsertAllScript.Run(ctx, s.Rds, scriptKeys, args...).Slice()
+	if err != nil {
+		return MultiInsertResult{Rejected: 0}, err
+	}
+	return parseMultiResult(ret), nil
+}
+
+// ARGV: uid, ttl, 每个 key 的 limit
+const setTryInsertAllLua = `
+local ret = {}
+for i, k in ipairs(KEYS) do
+	if redis.call('SISMEMBER', k, ARGV[1]) == 1 then
+		ret[i] = 2
+	elseif redis.call('SCARD', k) >= tonumber(ARGV[2+i]) then
+		return {i}
+	else
+		ret[i] = 1
+	end
+end
+for i, k in ipairs(KEYS) do
+	if ret[i] == 1 then redis.call('SADD', k, ARGV[1]) end
+	if tonumber(ARGV[2]) > 0 then redis.call('EXPIRE', k, ARGV[2]) end
+end
+return {0, unpack(ret)}`
+
+func (s *RedisSet) TryInsertAll(ctx context.Context, uid string, keys []string, limits []int) (MultiInsertResult, error) {
+	i, err := checkMultiKeys(keys, limits)
+	if err != nil {
+		return MultiInsertResult{Rejected: 0}, err
+	}
+	if i >= 0 {
+		return MultiInsertResult{Rejected: i}, nil
+	}
+	args := []interface{}{uid, ttlSeconds(s.TTL)}
+	for _, limit := range limits {
+		args = append(args, limit)
+	}
+	ret, err := setTryInsertAllScript.Run(ctx, s.Rds, keys, args...).Slice()
+	if err != nil {
+		return MultiInsertResult{Rejected: 0}, err
+	}
+	return parseMultiResult(ret), nil
+}
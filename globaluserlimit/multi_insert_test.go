@@ -0,0 +1,55 @@
+package globaluserlimit
+
+import (
+	"context"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestUserLimitHelper_TryInsertAll(t *testing.T) {
+	rds := newTestRedis(t)
+	ctx := context.Background()
+	for name, elem := range newTestLimitElems(t) {
+		if _, ok := elem.(MultiInserter); !ok {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			global := HashTagKey(key+":"+name, "global")
+			region := HashTagKey(key+":"+name, "region:cn")
+			rds.Del(ctx, global, region, reservationKey(global), reservationKey(region))
+			defer rds.Del(ctx, global, region, reservationKey(global), reservationKey(region))
+
+			ulh := UserLimitHelper{LimitElem: elem}
+			rules := []Rule{{Limit: 3, Args: []any{global}}, {Limit: 1, Args: []any{region}}}
+
+			ret, err := ulh.TryInsertAll(ctx, "u1", rules...)
+			assert.NilError(t, err)
+			assert.Assert(t, ret.Admitted())
+			assert.DeepEqual(t, []InsertResult{adm, adm}, ret.Results)
+
+			// region 拒绝，global 不变
+			ret, err = ulh.TryInsertAll(ctx, "u2", rules...)
+			assert.NilError(t, err)
+			assert.Assert(t, !ret.Admitted())
+			assert.Equal(t, 1, ret.Rejected)
+			limited, err := elem.IsLimited(ctx, global, 0)
+			assert.NilError(t, err)
+			assert.Assert(t, limited)
+			limited, err = elem.IsLimited(ctx, global, 1)
+			assert.NilError(t, err)
+			assert.Assert(t, !limited)
+
+			ret, err = ulh.TryInsertAll(ctx, "u1", rules...)
+			assert.NilError(t, err)
+			assert.DeepEqual(t, []InsertResult{alr, alr}, ret.Results)
+
+			ret, err = ulh.TryInsertAll(ctx, "u2", Rule{Limit: 0, Args: []any{global}}, rules[1])
+			assert.NilError(t, err)
+			assert.Equal(t, 0, ret.Rejected)
+
+			_, err = ulh.TryInsertAll(ctx, "u2", rules[0], Rule{Limit: 1, Args: []any{key}})
+			assert.Equal(t, ErrCrossSlot, err)
+		})
+	}
+}
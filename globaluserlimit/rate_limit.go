@@ -0,0 +1,226 @@
+package globaluserlimit
+
+import (
+	"context"
+	"math"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RateResult 限流的结果
+type RateResult struct {
+	Allowed    bool
+	Remaining  int           // 当前还可以立即通过的请求数
+	RetryAfter time.Duration // 被拒绝时多久之后可以重试，通过时为 0
+}
+
+type RateElem interface {
+	// Allow 尝试消耗 n 个配额，检查和扣减是原子的
+	Allow(ctx context.Context, key string, n int) (RateResult, error)
+
+	Key(args ...any) string
+}
+
+/*
+RateLimit 每 Period 允许 Rate 个请求，最多突发 Burst 个，Burst 为 0 时等于 Rate。
+例如 {Rate: 10, Period: time.Second} 为 10 QPS，{Rate: 100, Period: time.Minute, Burst: 10}
+为每分钟 100 个请求，但最多连续 10 个。
+
+RedisTokenBucket 和 RedisGCRA 的限流效果相同，区别在于存储: 令牌桶保存剩余令牌和上次补充的时间，
+GCRA 只保存一个理论到达时间，key 更小。时间取自客户端，多个实例之间需要同步时钟。
+*/
+type RateLimit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+func (l RateLimit) burst() int {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// interval 每个请求的间隔，毫秒
+func (l RateLimit) interval() float64 {
+	return float64(l.Period.Milliseconds()) / float64(l.Rate)
+}
+
+func (l RateLimit) valid() bool {
+	return l.Rate > 0 && l.Period.Milliseconds() > 0 && l.Burst >= 0
+}
+
+// RedisTokenBucket 令牌桶，桶的容量为 Burst，每 Period 补充 Rate 个令牌
+type RedisTokenBucket struct {
+	Rds   redis.UniversalClient
+	Limit RateLimit
+
+	now func() time.Time
+}
+
+type RedisTokenBucketSingleKeyImpl struct {
+	RedisTokenBucket
+}
+
+func (r *RedisTokenBucketSingleKeyImpl) Key(args ...any) string {
+	return args[0].(string)
+}
+
+func NewRedisTokenBucket(rds redis.UniversalClient, limit RateLimit) (*RedisTokenBucket, error) {
+	if !limit.valid() {
+		return nil, ErrBadConfig
+	}
+	return &RedisTokenBucket{
+		Rds:   rds,
+		Limit: limit,
+	}, nil
+}
+
+// ARGV: 容量, 每个令牌的间隔(毫秒), 当前时间(毫秒), n
+// 返回 {是否通过, 剩余令牌, 重试等待(毫秒)}
+const tokenBucketLua = `
+local cap = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local v = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(v[1]) or cap
+local ts = tonumber(v[2]) or now
+if now > ts then
+	tokens = math.min(cap, tokens + (now - ts) / interval)
+	ts = now
+end
+local allowed, retry = 0, 0
+if tokens >= n then
+	tokens = tokens - n
+	allowed = 1
+else
+	retry = math.ceil((n - tokens) * interval)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(ts))
+redis.call('PEXPIRE', KEYS[1], math.ceil(cap * interval) + 1000)
+return {allowed, math.floor(tokens), retry}`
+
+// Allow n 超过 Burst 时永远不会通过，返回 ErrBadConfig
+func (s *RedisTokenBucket) Allow(ctx context.Context, key string, n int) (RateResult, error) {
+	if n <= 0 || n > s.Limit.burst() {
+		return RateResult{}, ErrBadConfig
+	}
+	ret, err := tokenBucketScript.Run(ctx, s.Rds, []string{key},
+		s.Limit.burst(), s.Limit.interval(), rateNow(s.now), n).Slice()
+	if err != nil {
+		return RateResult{}, err
+	}
+	return parseRateResult(ret), nil
+}
+
+// RedisGCRA 通用信元速率算法(漏桶的一种实现)，key 只保存理论到达时间(TAT)
+type RedisGCRA struct {
+	Rds   redis.UniversalClient
+	Limit RateLimit
+
+	now func() time.Time
+}
+
+type RedisGCRASingleKeyImpl struct {
+	RedisGCRA
+}
+
+func (r *RedisGCRASingleKeyImpl) Key(args ...any) string {
+	return args[0].(string)
+}
+
+func NewRedisGCRA(rds redis.UniversalClient, limit RateLimit) (*RedisGCRA, error) {
+	if !limit.valid() {
+		return nil, ErrBadConfig
+	}
+	return &RedisGCRA{
+		Rds:   rds,
+		Limit: limit,
+	}, nil
+}
+
+// ARGV: 突发容量, 每个请求的间隔(毫秒), 当前时间(毫秒), n
+// 返回 {是否通过, 剩余请求数, 重试等待(毫秒)}
+const gcraLua = `
+local burst = tonumber(ARGV[1])
+local interval = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local n = tonumber(ARGV[4])
+local tolerance = burst * interval
+local tat = math.max(tonumber(redis.call('GET', KEYS[1]) or now), now)
+local newTat = tat + n * interval
+local allowAt = newTat - tolerance
+if allowAt > now then
+	return {0, math.floor((tolerance - (tat - now)) / interval), math.ceil(allowAt - now)}
+end
+redis.call('SET', KEYS[1], tostring(newTat), 'PX', math.ceil(newTat - now))
+return {1, math.floor((tolerance - (newTat - now)) / interval), 0}`
+
+// Allow n 超过 Burst 时永远不会通过，返回 ErrBadConfig
+func (s *RedisGCRA) Allow(ctx context.Context, key string, n int) (RateResult, error) {
+	if n <= 0 || n > s.Limit.burst() {
+		return RateResult{}, ErrBadConfig
+	}
+	ret, err := gcraScript.Run(ctx, s.Rds, []string{key},
+		s.Limit.burst(), s.Limit.interval(), rateNow(s.now), n).Slice()
+	if err != nil {
+		return RateResult{}, err
+	}
+	return parseRateResult(ret), nil
+}
+
+func rateNow(now func() time.Time) int64 {
+	if now != nil {
+		return now().UnixMilli()
+	}
+	return time.Now().UnixMilli()
+}
+
+func parseRateResult(ret []interface{}) RateResult {
+	return RateResult{
+		Allowed:    ret[0].(int64) == 1,
+		Remaining:  int(math.Max(float64(ret[1].(int64)), 0)),
+		RetryAfter: time.Duration(ret[2].(int64)) * time.Millisecond,
+	}
+}
+
+// RateLimitHelper 与 UserLimitHelper 相同的本地受限缓存: 被拒绝后 min(LimitCacheTime, RetryAfter) 内不再访问 Redis
+type RateLimitHelper struct {
+	RateElem
+
+	LimitCacheTime time.Duration
+	LimitCacheSize int // 本地缓存最多保存的 key 数，默认 DefaultLimitCacheSize
+
+	limitStateCache limitedCache
+}
+
+// Allow 消耗 1 个配额
+func (h *RateLimitHelper) Allow(ctx context.Context, args ...any) (RateResult, error) {
+	return h.AllowN(ctx, 1, args...)
+}
+
+// AllowN 消耗 n 个配额，命中本地受限缓存时 RetryAfter 为缓存的剩余时间
+func (h *RateLimitHelper) AllowN(ctx context.Context, n int, args ...any) (RateResult, error) {
+	key := h.RateElem.Key(args...)
+	if h.LimitCacheTime > 0 {
+		if left, ok := h.limitStateCache.check(key, 0); ok {
+			return RateResult{RetryAfter: left}, nil
+		}
+	}
+
+	ret, err := h.RateElem.Allow(ctx, key, n)
+	if err != nil {
+		return RateResult{}, err
+	}
+	if !ret.Allowed && h.LimitCacheTime > 0 {
+		cacheTime := h.LimitCacheTime
+		if ret.RetryAfter < cacheTime {
+			cacheTime = ret.RetryAfter
+		}
+		h.limitStateCache.update(key, 0, cacheTime, h.LimitCacheSize)
+	}
+	return ret, nil
+}
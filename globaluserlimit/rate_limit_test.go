@@ -0,0 +1,98 @@
+package globaluserlimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func newTestRateElems(t *testing.T, limit RateLimit, now func() time.Time) map[string]RateElem {
+	rds := newTestRedis(t)
+	tb, err := NewRedisTokenBucket(rds, limit)
+	assert.NilError(t, err)
+	tb.now = now
+	gcra, err := NewRedisGCRA(rds, limit)
+	assert.NilError(t, err)
+	gcra.now = now
+	return map[string]RateElem{
+		"RedisTokenBucket": &RedisTokenBucketSingleKeyImpl{RedisTokenBucket: *tb},
+		"RedisGCRA":        &RedisGCRASingleKeyImpl{RedisGCRA: *gcra},
+	}
+}
+
+func TestRateElem(t *testing.T) {
+	rds := newTestRedis(t)
+	ctx := context.Background()
+	var now time.Time
+	for name, elem := range newTestRateElems(t, RateLimit{Rate: 10, Period: time.Second, Burst: 5}, func() time.Time { return now }) {
+		t.Run(name, func(t *testing.T) {
+			k := key + ":" + name
+			rds.Del(ctx, k)
+			defer rds.Del(ctx, k)
+			now = time.Now()
+
+			for i := 4; i >= 0; i-- {
+				ret, err := elem.Allow(ctx, k, 1)
+				assert.NilError(t, err)
+				assert.Equal(t, RateResult{Allowed: true, Remaining: i}, ret)
+			}
+			ret, err := elem.Allow(ctx, k, 1)
+			assert.NilError(t, err)
+			assert.Equal(t, RateResult{Allowed: false, Remaining: 0, RetryAfter: 100 * time.Millisecond}, ret)
+
+			now = now.Add(100 * time.Millisecond)
+			ret, err = elem.Allow(ctx, k, 1)
+			assert.NilError(t, err)
+			assert.Equal(t, RateResult{Allowed: true, Remaining: 0}, ret)
+			ret, err = elem.Allow(ctx, k, 2)
+			assert.NilError(t, err)
+			assert.Equal(t, RateResult{Allowed: false, Remaining: 0, RetryAfter: 200 * time.Millisecond}, ret)
+
+			// 补满之后最多突发 Burst 个
+			now = now.Add(time.Second)
+			ret, err = elem.Allow(ctx, k, 5)
+			assert.NilError(t, err)
+			assert.Equal(t, RateResult{Allowed: true, Remaining: 0}, ret)
+
+			_, err = elem.Allow(ctx, k, 6)
+			assert.Equal(t, ErrBadConfig, err)
+		})
+	}
+}
+
+func TestRateLimitHelper(t *testing.T) {
+	rds := newTestRedis(t)
+	ctx := context.Background()
+	for name, elem := range newTestRateElems(t, RateLimit{Rate: 1, Period: time.Minute}, nil) {
+		t.Run(name, func(t *testing.T) {
+			k := key + ":" + name
+			rds.Del(ctx, k)
+			defer rds.Del(ctx, k)
+			h := RateLimitHelper{RateElem: elem, LimitCacheTime: time.Second}
+
+			ret, err := h.Allow(ctx, k)
+			assert.NilError(t, err)
+			assert.Assert(t, ret.Allowed)
+			ret, err = h.Allow(ctx, k)
+			assert.NilError(t, err)
+			assert.Assert(t, !ret.Allowed)
+			assert.Assert(t, ret.RetryAfter > 59*time.Second, ret.RetryAfter)
+
+			// 命中本地缓存，不访问 Redis，RetryAfter 为缓存的剩余时间
+			rds.Del(ctx, k)
+			ret, err = h.Allow(ctx, k)
+			assert.NilError(t, err)
+			assert.Assert(t, !ret.Allowed)
+			assert.Assert(t, ret.RetryAfter > 0 && ret.RetryAfter <= time.Second, ret.RetryAfter)
+		})
+	}
+}
+
+func TestRateLimit_Invalid(t *testing.T) {
+	_, err := NewRedisTokenBucket(nil, RateLimit{Rate: 0, Period: time.Second})
+	assert.Equal(t, ErrBadConfig, err)
+	_, err = NewRedisGCRA(nil, RateLimit{Rate: 1})
+	assert.Equal(t, ErrBadConfig, err)
+}
@@ -3,71 +3,175 @@ package globaluserlimit
 import (
 	"context"
 	"github.com/go-redis/redis/v8"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// RedisHash 精确计数，每个用户是 hash 的一个 field，值为第一次计入的时间戳(秒)。
+// 支持两阶段的 Reserve/Commit/Cancel，见 Reservation。
 type RedisHash struct {
-	Rds *redis.Client
+	Rds redis.UniversalClient
 	TTL time.Duration
 
 	// 用于非精确计数，以下两个有一个为0则立即更新，只有两个都非0才会Cache
 	batchUpdateSize int
 	batchUpdateDur  time.Duration
+	batch           *batchBuffer
 }
 
-func NewRedisHash(rds *redis.Client, ttl time.Duration, size, dur int) (*RedisHash, error) {
+type RedisHashSingleKeyImpl struct {
+	RedisHash
+}
+
+func (r *RedisHashSingleKeyImpl) Key(args ...any) string {
+	return args[0].(string)
+}
+
+// NewRedisHash size 和 dur(秒) 的含义同 NewRedisHLL，开启缓冲后退出前需要调用 Close
+func NewRedisHash(rds redis.UniversalClient, ttl time.Duration, size, dur int) (*RedisHash, error) {
 	if size < 0 || dur < 0 {
 		return nil, ErrBadConfig
 	}
 
-	return &RedisHash{
+	s := &RedisHash{
 		Rds:             rds,
 		TTL:             ttl,
 		batchUpdateSize: size,
 		batchUpdateDur:  time.Duration(dur) * time.Second,
-	}, nil
+	}
+	s.batch = newBatchBuffer(s.batchUpdateSize, s.batchUpdateDur, s.flushBatch)
+	return s, nil
 }
 
+// ARGV: limit, uid, 计入时间戳(秒), ttl, 当前时间(毫秒)
+// 返回值 0: 达到限量被拒绝，1: 新计入，2: 之前已经计入或者持有预留
+const hashTryInsertLua = hashLuaPrelude + `
+reclaim(ARGV[5])
+if redis.call('HEXISTS', KEYS[1], ARGV[2]) == 1 then
+	expire(ARGV[4])
+	return 2
+end
+if redis.call('HLEN', KEYS[1]) >= tonumber(ARGV[1]) then return 0 end
+redis.call('HSET', KEYS[1], ARGV[2], ARGV[3])
+expire(ARGV[4])
+return 1`
+
+// ARGV: uid, 计入时间戳(秒), ttl, 当前时间(毫秒)
+const hashInsertUserLua = hashLuaPrelude + `
+reclaim(ARGV[4])
+redis.call('HSETNX', KEYS[1], ARGV[1], ARGV[2])
+expire(ARGV[3])
+return redis.call('HLEN', KEYS[1])`
+
 func (s *RedisHash) TryInsert(ctx context.Context, key string, limit int, uid string) (bool, error) {
+	ret, err := s.TryInsertResult(ctx, key, limit, uid)
+	return ret.Admitted(), err
+}
+
+func (s *RedisHash) TryInsertResult(ctx context.Context, key string, limit int, uid string) (InsertResult, error) {
 	if limit <= 0 {
-		return false, nil
+		return InsertRejected, nil
 	}
 
-	var luaRet interface{}
-	var err error
-	if s.TTL == 0 {
-		luaScript := "local i = redis.call('HLEN', KEYS[1]); if i > tonumber(ARGV[1]) then return 1; end; " +
-			"redis.call('HSET', KEYS[1], ARGV[2], ARGV[3]); return 0;"
-		luaRet, err = s.Rds.Eval(ctx, luaScript, []string{key}, limit, uid).Result()
-	} else {
-		luaScript := "local i = redis.call('HLEN', KEYS[1]); if i > tonumber(ARGV[1]) then return 1; end; " +
-			"redis.call('HSET', KEYS[1], ARGV[2], ARGV[3]); redis.call('EXPIRE', KEYS[1], ARGV[4]); return 0;"
-		luaRet, err = s.Rds.Eval(ctx, luaScript, []string{key}, limit, uid, s.TTL).Result()
-	}
+	now := time.Now()
+	ret, err := hashTryInsertScript.Run(ctx, s.Rds, []string{key, reservationKey(key)},
+		limit, uid, now.Unix(), ttlSeconds(s.TTL), now.UnixMilli()).Int64()
 	if err != nil {
-		return false, err
+		return InsertRejected, err
 	}
-
-	return luaRet.(int64) == 0, nil
+	return InsertResult(ret), nil
 }
 
+// InsertUser 不检查限量直接插入，返回当前用户数
 func (s *RedisHash) InsertUser(ctx context.Context, key, uid string) (int, error) {
-	i, err := s.Rds.PFAdd(ctx, key, uid).Result()
+	if s.batch != nil {
+		return s.batch.add(ctx, key, uid)
+	}
+
+	now := time.Now()
+	ret, err := hashInsertUserScript.Run(ctx, s.Rds, []string{key, reservationKey(key)},
+		uid, now.Unix(), ttlSeconds(s.TTL), now.UnixMilli()).Int64()
 	if err != nil {
 		return 0, err
 	}
-	if s.TTL == 0 {
-		return int(i), nil
-	}
-	_, err = s.Expire(ctx, key, s.TTL)
-	return int(i), err
+	return int(ret), nil
 }
 
+// IsLimited 与 RedisHLL 一致，用户数超过 limit 时返回 true。
+// 预留中的用户也占用名额，过期的预留在下一次写入时才回收。
 func (s *RedisHash) IsLimited(ctx context.Context, key string, limit int) (bool, error) {
-	i, err := s.Rds.PFCount(ctx, key).Result()
+	i, err := s.Rds.HLen(ctx, key).Result()
 	return int(i) > limit, err
 }
 
+// Count 用户数，包含预留中的用户，不包含本地缓冲中还没有写入的用户
+func (s *RedisHash) Count(ctx context.Context, key string) (int, error) {
+	i, err := s.Rds.HLen(ctx, key).Result()
+	return int(i), err
+}
+
+func (s *RedisHash) KeyTTL(ctx context.Context, key string) (time.Duration, error) {
+	return keyTTL(ctx, s.Rds, key)
+}
+
+// Reset 删除用户和所有预留，之后 Commit 已有的预留返回 false，本地缓冲中还没有写入的用户之后仍会写入
+func (s *RedisHash) Reset(ctx context.Context, key string) error {
+	return s.Rds.Del(ctx, key, reservationKey(key)).Err()
+}
+
+// Contains 用户是否已经计入或者持有预留
+func (s *RedisHash) Contains(ctx context.Context, key, uid string) (bool, error) {
+	return s.Rds.HExists(ctx, key, uid).Result()
+}
+
+// InsertTime 返回用户第一次被计入的时间，用户不存在时返回 redis.Nil，预留未确认时返回 ErrNotCommitted
+func (s *RedisHash) InsertTime(ctx context.Context, key, uid string) (time.Time, error) {
+	v, err := s.Rds.HGet(ctx, key, uid).Result()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if strings.HasPrefix(v, "r:") {
+		return time.Time{}, ErrNotCommitted
+	}
+	ts, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(ts, 0), nil
+}
+
 func (s *RedisHash) Expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
 	return s.Rds.Expire(ctx, key, ttl).Result()
 }
+
+// ExpireAt 用户 hash 和预留 zset 在 tm 过期，返回用户 hash 是否存在
+func (s *RedisHash) ExpireAt(ctx context.Context, key string, tm time.Time) (bool, error) {
+	var ret *redis.BoolCmd
+	_, err := s.Rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		ret = pipe.ExpireAt(ctx, key, tm)
+		pipe.ExpireAt(ctx, reservationKey(key), tm)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return ret.Val(), nil
+}
+
+// flushBatch 一次 pipeline 写入所有缓冲的用户
+func (s *RedisHash) flushBatch(ctx context.Context, pending map[string][]string) (map[string]int, error) {
+	now := time.Now().Unix()
+	return pipelineFlush(ctx, s.Rds, s.TTL, pending, func(pipe redis.Pipeliner, key string, uids []string) {
+		for _, uid := range uids {
+			pipe.HSetNX(ctx, key, uid, now)
+		}
+	}, func(pipe redis.Pipeliner, key string) *redis.IntCmd {
+		return pipe.HLen(ctx, key)
+	})
+}
+
+// Close 写入本地缓冲的用户，未开启缓冲时什么也不做
+func (s *RedisHash) Close() error {
+	return s.batch.shutdown()
+}
@@ -8,16 +8,19 @@ import (
 )
 
 var (
-	ErrBadConfig = errors.New("bad config")
+	ErrBadConfig    = errors.New("bad config")
+	ErrNotSupported = errors.New("not supported")
+	ErrNotCommitted = errors.New("reservation not committed")
 )
 
 type RedisHLL struct {
-	Rds *redis.Client
+	Rds redis.UniversalClient
 	TTL time.Duration
 
 	// 用于非精确计数，以下两个有一个为0则立即更新，只有两个都非0才会Cache
 	batchUpdateSize int
 	batchUpdateDur  time.Duration
+	batch           *batchBuffer
 }
 
 type RedisHLLSingleKeyImpl struct {
@@ -28,60 +31,82 @@ func (r *RedisHLLSingleKeyImpl) Key(args ...any) string {
 	return args[0].(string)
 }
 
-func NewRedisHLL(rds *redis.Client, ttl time.Duration, size, dur int) (*RedisHLL, error) {
+// NewRedisHLL size 和 dur(秒) 都非0时 InsertUser 在本地缓冲，攒够 size 个用户或者每隔 dur 秒
+// 用一次 pipeline 批量 PFADD，精度的取舍见 batchBuffer。TryInsert 始终同步访问 Redis。
+// 开启缓冲后退出前需要调用 Close。
+func NewRedisHLL(rds redis.UniversalClient, ttl time.Duration, size, dur int) (*RedisHLL, error) {
 	if size < 0 || dur < 0 {
 		return nil, ErrBadConfig
 	}
 
-	return &RedisHLL{
+	s := &RedisHLL{
 		Rds:             rds,
 		TTL:             ttl,
 		batchUpdateSize: size,
 		batchUpdateDur:  time.Duration(dur) * time.Second,
-	}, nil
+	}
+	s.batch = newBatchBuffer(s.batchUpdateSize, s.batchUpdateDur, s.flushBatch)
+	return s, nil
 }
 
+/*
+hllTryInsertLua 返回值 0: 达到限量被拒绝，1: 新计入，2: 之前已经计入。
+
+HLL 无法精确判断成员，以插入后基数估计是否增加作为近似: 没有增加说明用户(很可能)已经计入，
+极少数新用户会因为哈希碰撞被当作已经计入，但此时基数估计不变，不会因此超出限量。
+达到限量时把 KEYS[1] 合并到临时的 KEYS[2] 上试探，不修改 KEYS[1]。
+*/
+const hllTryInsertLua = `
+local n = redis.call('PFCOUNT', KEYS[1])
+if n < tonumber(ARGV[1]) then
+	redis.call('PFADD', KEYS[1], ARGV[2])
+	if tonumber(ARGV[3]) > 0 then redis.call('EXPIRE', KEYS[1], ARGV[3]) end
+	if redis.call('PFCOUNT', KEYS[1]) > n then return 1 end
+	return 2
+end
+redis.call('DEL', KEYS[2])
+redis.call('PFMERGE', KEYS[2], KEYS[1])
+redis.call('PFADD', KEYS[2], ARGV[2])
+local m = redis.call('PFCOUNT', KEYS[2])
+redis.call('DEL', KEYS[2])
+if m > n then return 0 end
+if tonumber(ARGV[3]) > 0 then redis.call('EXPIRE', KEYS[1], ARGV[3]) end
+return 2`
+
+// hllInsertUserLua 返回插入后的用户数
+const hllInsertUserLua = `
+redis.call('PFADD', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 then redis.call('EXPIRE', KEYS[1], ARGV[2]) end
+return redis.call('PFCOUNT', KEYS[1])`
+
 func (s *RedisHLL) TryInsert(ctx context.Context, key string, limit int, uid string) (bool, error) {
+	ret, err := s.TryInsertResult(ctx, key, limit, uid)
+	return ret.Admitted(), err
+}
+
+func (s *RedisHLL) TryInsertResult(ctx context.Context, key string, limit int, uid string) (InsertResult, error) {
 	if limit <= 0 {
-		return false, nil
+		return InsertRejected, nil
 	}
 
-	var luaRet interface{}
-	var err error
-
-	if s.TTL == 0 {
-		luaScript := "local i = redis.call('PFCOUNT', KEYS[1]); if i >= tonumber(ARGV[1]) then return 1; end;" +
-			" redis.call('PFADD', KEYS[1], ARGV[2]); return 0;"
-		luaRet, err = s.Rds.Eval(ctx, luaScript, []string{key}, limit, uid).Result()
-	} else {
-		luaScript := "local i = redis.call('PFCOUNT', KEYS[1]); if i >= tonumber(ARGV[1]) then return 1; end; " +
-			"redis.call('PFADD', KEYS[1], ARGV[2]); redis.call('EXPIRE', KEYS[1], ARGV[3]); return 0;"
-		luaRet, err = s.Rds.Eval(ctx, luaScript, []string{key}, limit, uid, s.TTL.Seconds()).Result()
-	}
+	keys := []string{key, companionKey(key, ":probe")}
+	ret, err := hllTryInsertScript.Run(ctx, s.Rds, keys, limit, uid, ttlSeconds(s.TTL)).Int64()
 	if err != nil {
-		return false, err
+		return InsertRejected, err
 	}
-
-	return luaRet.(int64) == 0, nil
+	return InsertResult(ret), nil
 }
 
 func (s *RedisHLL) InsertUser(ctx context.Context, key, uid string) (int, error) {
-
-	var lua string
-	var ret interface{}
-	var err error
-
-	if s.TTL == 0 {
-		lua = "local i = redis.call('PFADD', KEYS[1], ARGV[1]); return redis.call('PFCOUNT', KEYS[1]);"
-		ret, err = s.Rds.Eval(ctx, lua, []string{key}, uid).Result()
-	} else {
-		lua = "local i = redis.call('PFADD', KEYS[1], ARGV[1]); redis.call('EXPIRE', KEYS[1], ARGV[2]); return redis.call('PFCOUNT', KEYS[1]);"
-		ret, err = s.Rds.Eval(ctx, lua, []string{key}, uid, s.TTL.Seconds()).Result()
+	if s.batch != nil {
+		return s.batch.add(ctx, key, uid)
 	}
+
+	ret, err := hllInsertUserScript.Run(ctx, s.Rds, []string{key}, uid, ttlSeconds(s.TTL)).Int64()
 	if err != nil {
 		return 0, err
 	}
-	return int(ret.(int64)), nil
+	return int(ret), nil
 }
 
 func (s *RedisHLL) IsLimited(ctx context.Context, key string, limit int) (bool, error) {
@@ -89,6 +114,49 @@ func (s *RedisHLL) IsLimited(ctx context.Context, key string, limit int) (bool,
 	return int(i) > limit, err
 }
 
+// Count 近似的用户数，不包含本地缓冲中还没有写入的用户
+func (s *RedisHLL) Count(ctx context.Context, key string) (int, error) {
+	i, err := s.Rds.PFCount(ctx, key).Result()
+	return int(i), err
+}
+
+func (s *RedisHLL) KeyTTL(ctx context.Context, key string) (time.Duration, error) {
+	return keyTTL(ctx, s.Rds, key)
+}
+
+// Reset 删除 key，本地缓冲中还没有写入的用户之后仍会写入
+func (s *RedisHLL) Reset(ctx context.Context, key string) error {
+	return s.Rds.Del(ctx, key, companionKey(key, ":probe")).Err()
+}
+
+// flushBatch 一次 pipeline 写入所有缓冲的用户
+func (s *RedisHLL) flushBatch(ctx context.Context, pending map[string][]string) (map[string]int, error) {
+	return pipelineFlush(ctx, s.Rds, s.TTL, pending, func(pipe redis.Pipeliner, key string, uids []string) {
+		members := make([]interface{}, len(uids))
+		for i, uid := range uids {
+			members[i] = uid
+		}
+		pipe.PFAdd(ctx, key, members...)
+	}, func(pipe redis.Pipeliner, key string) *redis.IntCmd {
+		return pipe.PFCount(ctx, key)
+	})
+}
+
+// Close 写入本地缓冲的用户，未开启缓冲时什么也不做
+func (s *RedisHLL) Close() error {
+	return s.batch.shutdown()
+}
+
+// ttlSeconds 向上取整，避免不足一秒的 TTL 变成 EXPIRE 0
+func ttlSeconds(ttl time.Duration) int64 {
+	return int64((ttl + time.Second - 1) / time.Second)
+}
+
 func (s *RedisHLL) expire(ctx context.Context, key string, ttl time.Duration) (bool, error) {
 	return s.Rds.Expire(ctx, key, ttl).Result()
 }
+
+// ExpireAt key 在 tm 过期，key 不存在时返回 false
+func (s *RedisHLL) ExpireAt(ctx context.Context, key string, tm time.Time) (bool, error) {
+	return s.Rds.ExpireAt(ctx, key, tm).Result()
+}
@@ -10,6 +10,8 @@ import (
 	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/wlbgo/utils/internal/redistest"
 )
 
 const (
@@ -18,7 +20,7 @@ const (
 
 func TestRedisHLL_Expire(t *testing.T) {
 
-	rds := newTestRedis()
+	rds := newTestRedis(t)
 	hll, err := NewRedisHLL(rds, 200*time.Second, 0, 0)
 	if err != nil {
 		panic(err)
@@ -44,7 +46,7 @@ func TestRedisHLL_Expire(t *testing.T) {
 
 func TestRedisHLL_TryInsert(t *testing.T) {
 
-	rds := newTestRedis()
+	rds := newTestRedis(t)
 	hll, err := NewRedisHLL(rds, 0, 0, 0)
 	if err != nil {
 		panic(err)
@@ -86,7 +88,7 @@ func TestRedisHLL_TryInsert(t *testing.T) {
 
 func TestRedisHLL_IsLimited1(t *testing.T) {
 
-	rds := newTestRedis()
+	rds := newTestRedis(t)
 	hll, err := NewRedisHLL(rds, 0, 0, 0)
 	if err != nil {
 		panic(err)
@@ -118,10 +120,45 @@ func TestRedisHLL_IsLimited1(t *testing.T) {
 	}
 }
 
-func newTestRedis() *redis.Client {
-	return redis.NewClient(&redis.Options{
+func TestRedisHLL_BatchInsertUser(t *testing.T) {
+
+	rds := newTestRedis(t)
+	hll, err := NewRedisHLL(rds, 0, 10, 1)
+	if err != nil {
+		panic(err)
+	}
+
+	ctx := context.Background()
+	rds.Del(ctx, key)
+	defer rds.Del(ctx, key)
+
+	for i := 0; i < 15; i++ {
+		_, err := hll.InsertUser(ctx, key, "uid"+strconv.Itoa(i))
+		assert.NilError(t, err)
+	}
+	// 前10个已经批量写入，后5个还在本地缓冲
+	cnt, err := rds.PFCount(ctx, key).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(10), cnt)
+
+	assert.NilError(t, hll.Close())
+	cnt, err = rds.PFCount(ctx, key).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(15), cnt)
+}
+
+// newTestRedis 连接本地的测试 Redis，连接不上时跳过测试
+func newTestRedis(t testing.TB) *redis.Client {
+	rds := redis.NewClient(&redis.Options{
 		Addr:     "localhost:6379",
 		Password: "test",
 	})
-
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := rds.Ping(ctx).Err(); err != nil {
+		// 没有本地的 Redis 时使用进程内的 miniredis
+		_ = rds.Close()
+		return redistest.NewMemory(t)
+	}
+	return rds
 }
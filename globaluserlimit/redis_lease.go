@@ -0,0 +1,375 @@
+package globaluserlimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+var (
+	_ LimitElem     = &RedisLeaseSingleKeyImpl{}
+	_ MemberChecker = &RedisLease{}
+	_ ExpireAter    = &RedisLease{}
+)
+
+// leaseIdleRounds 租约到期并且归还后，超过多少个 LeaseTime 没有租用的 key 不再保留本地计入的用户
+const leaseIdleRounds = 10
+
+/*
+RedisLease 租约模式，用于单个 key QPS 很高的场景(例如秒杀)。每个实例一次从 Redis 原子地租用 Size 个名额，
+之后在本地计入用户，名额用完或者租约到期(LeaseTime)时再访问 Redis，同时归还未使用的名额并写入本地计入的用户。
+
+key 为 SET，保存已经写入的用户，辅助 key(见 companionKey) 为 hash，n 为已经分配的名额数(已经写入的用户加上所有实例租用未使用的)，
+租用时 n 不会超过 limit，所以所有实例一共计入的用户数不会超过 limit。
+
+精度上的取舍:
+  - 按用户去重在本实例内是精确的，跨实例只能看到已经写入 Redis 的用户，同一个用户在写入前到其他实例可能再占用一个名额，
+    重复的用户不会超过 limit，但会少计入新用户；
+  - Count、IsLimited 是 Redis 中的用户加上本实例还没有写入的用户，不包括其他实例还没有写入的用户；
+  - 其他实例还有租用未使用的名额时，本实例租不到名额会直接拒绝；
+  - 同一个 key 同时只有一个请求访问 Redis 租用，其他请求等待它完成；与 Reset 同时进行的租用结果丢弃，
+    租到的名额在 key 过期前不能使用；
+  - 后台每隔 LeaseTime 归还到期租约的名额，正常退出需要调用 Close。进程异常退出时租用未使用的名额不会归还，
+    本地计入还没有写入的用户也会丢失，之后只会少计入，不会超过 limit，直到 key 过期或者 Reset；
+  - 访问 Redis 出错时(包括超时，脚本可能已经执行)本地不再使用归还的名额，还没有写入的用户下一次重试；
+  - Reset 或者 key 过期后其他实例的旧租约作废，旧租约未使用的名额和还没有写入的用户在下一次访问 Redis 时丢弃；
+  - 本地计入的用户在分配计数过期后丢弃，超过 leaseIdleRounds 个 LeaseTime 没有访问 Redis 的 key 也会丢弃，
+    之后这些用户在本实例上和其他实例一样只能通过 Redis 去重。
+
+需要通过 NewRedisLease 创建。
+*/
+type RedisLease struct {
+	Rds       redis.UniversalClient
+	TTL       time.Duration
+	Size      int           // 每次租用的名额数
+	LeaseTime time.Duration // 租约的有效期
+
+	store *localAlloc[*leaseKey] // 本实例在每个 key 上的租约
+}
+
+type RedisLeaseSingleKeyImpl struct {
+	RedisLease
+}
+
+func (r *RedisLeaseSingleKeyImpl) Key(args ...any) string {
+	return args[0].(string)
+}
+
+// leaseKey 本实例在一个 key 上的租约和计入的用户
+type leaseKey struct {
+	gen           string // 租约所属的分配计数，Reset 后改变
+	left          int    // 租用未使用的名额
+	expireAt      time.Time
+	allocExpireAt time.Time           // 分配计数的过期时间，零值为不过期
+	users         map[string]struct{} // 本实例计入的用户，数量不超过租用的名额
+	pending       []string            // 还没有写入 Redis 的用户
+	allocFlight
+}
+
+func NewRedisLease(rds redis.UniversalClient, ttl time.Duration, size int, leaseTime time.Duration) (*RedisLease, error) {
+	if ttl < 0 || size <= 0 || leaseTime <= 0 {
+		return nil, ErrBadConfig
+	}
+	s := &RedisLease{
+		Rds:       rds,
+		TTL:       ttl,
+		Size:      size,
+		LeaseTime: leaseTime,
+	}
+	s.store = newLocalAlloc[*leaseKey](s.release)
+	s.store.start(leaseTime)
+	return s, nil
+}
+
+func leaseAllocKey(key string) string {
+	return companionKey(key, ":alloc")
+}
+
+/*
+leaseLua 写入本地计入的用户，归还未使用的名额，再租用新的名额。分配计数已经重建时(gen 不同)丢弃旧租约的用户和名额。
+ARGV: limit, 租用的名额数, TTL(秒), 本地的 gen, 新建时使用的 gen, 归还的名额数, uid, 本地计入的用户...
+返回 {租到的名额数, gen, uid 是否已经计入, 分配计数的 PTTL}
+*/
+const leaseLua = `
+local cur = redis.call('HMGET', KEYS[2], 'n', 'gen')
+local n, gen = tonumber(cur[1]), cur[2]
+if not n then
+	n, gen = redis.call('SCARD', KEYS[1]), ARGV[5]
+	redis.call('HSET', KEYS[2], 'n', n, 'gen', gen)
+elseif gen == ARGV[4] then
+	for i = 8, #ARGV do redis.call('SADD', KEYS[1], ARGV[i]) end
+	local unused = math.min(tonumber(ARGV[6]), n - redis.call('SCARD', KEYS[1]))
+	if unused > 0 then n = redis.call('HINCRBY', KEYS[2], 'n', -unused) end
+end
+local grant = math.max(math.min(tonumber(ARGV[2]), tonumber(ARGV[1]) - n), 0)
+if grant > 0 then redis.call('HINCRBY', KEYS[2], 'n', grant) end
+local member = redis.call('SISMEMBER', KEYS[1], ARGV[7])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('EXPIRE', KEYS[2], ARGV[3])
+	if redis.call('EXISTS', KEYS[1]) == 1 then redis.call('EXPIRE', KEYS[1], ARGV[3]) end
+end
+return {grant, gen, member, redis.call('PTTL', KEYS[2])}`
+
+// leaseInsertUserLua 返回插入后的用户数，新用户同时占用一个已经分配的名额
+const leaseInsertUserLua = `
+if redis.call('SADD', KEYS[1], ARGV[1]) == 1 and redis.call('EXISTS', KEYS[2]) == 1 then
+	redis.call('HINCRBY', KEYS[2], 'n', 1)
+end
+if tonumber(ARGV[2]) > 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[2])
+	if redis.call('EXISTS', KEYS[2]) == 1 then redis.call('EXPIRE', KEYS[2], ARGV[2]) end
+end
+return redis.call('SCARD', KEYS[1])`
+
+// entry 调用方需要持有锁，分配计数已经过期的 key 重新创建
+func (s *RedisLease) entry(key string) *leaseKey {
+	k, ok := s.store.entries[key]
+	if !ok || (!k.busy() && k.allocExpired(time.Now())) {
+		k = &leaseKey{users: make(map[string]struct{})}
+		s.store.entries[key] = k
+	}
+	return k
+}
+
+func (s *RedisLease) TryInsert(ctx context.Context, key string, limit int, uid string) (bool, error) {
+	ret, err := s.TryInsertResult(ctx, key, limit, uid)
+	return ret.Admitted(), err
+}
+
+func (s *RedisLease) TryInsertResult(ctx context.Context, key string, limit int, uid string) (InsertResult, error) {
+	if limit <= 0 {
+		return InsertRejected, nil
+	}
+	st := s.store
+	st.mutex.Lock()
+	var k *leaseKey
+	for {
+		k = s.entry(key)
+		if _, ok := k.users[uid]; ok {
+			st.mutex.Unlock()
+			return InsertAlreadyAdmitted, nil
+		}
+		if k.left > 0 && time.Now().Before(k.expireAt) {
+			k.left--
+			k.users[uid] = struct{}{}
+			k.pending = append(k.pending, uid)
+			st.mutex.Unlock()
+			return InsertAdmitted, nil
+		}
+		if !k.busy() {
+			break
+		}
+		// 其他请求正在租用，等待它取回新的名额
+		if err := st.wait(ctx, k); err != nil {
+			st.mutex.Unlock()
+			return InsertRejected, err
+		}
+	}
+	// 租约用完或者到期，取出未使用的名额和待写入的用户，和新的租用在一次请求中完成
+	gen, unused, pending := k.gen, k.left, k.pending
+	k.left, k.pending = 0, nil
+	k.begin()
+	st.mutex.Unlock()
+
+	res, err := s.lease(ctx, key, limit, s.Size, gen, unused, uid, pending)
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	defer k.done()
+	if st.entries[key] != k {
+		// Reset 删除了本地的租约，不知道租用在 Reset 之前还是之后，租到的名额丢弃
+		if err == nil && res.member {
+			return InsertAlreadyAdmitted, nil
+		}
+		return InsertRejected, err
+	}
+	if err != nil {
+		// 请求可能已经执行，归还的名额丢弃，只会少计入；用户放回下一次重试
+		k.pending = append(pending, k.pending...)
+		return InsertRejected, err
+	}
+	if k.gen != res.gen {
+		// 分配计数已经重建(Reset 或者过期)，本地的旧租约作废
+		k.gen, k.left, k.users = res.gen, 0, make(map[string]struct{})
+	}
+	now := time.Now()
+	k.left += res.grant
+	k.expireAt = now.Add(s.LeaseTime)
+	k.allocExpireAt = time.Time{}
+	if res.pttl > 0 {
+		k.allocExpireAt = now.Add(res.pttl)
+	}
+	if res.member {
+		k.users[uid] = struct{}{}
+		return InsertAlreadyAdmitted, nil
+	}
+	if k.left == 0 {
+		return InsertRejected, nil
+	}
+	k.left--
+	k.users[uid] = struct{}{}
+	k.pending = append(k.pending, uid)
+	return InsertAdmitted, nil
+}
+
+func (k *leaseKey) allocExpired(now time.Time) bool {
+	return !k.allocExpireAt.IsZero() && !now.Before(k.allocExpireAt)
+}
+
+// leaseResult leaseLua 的结果
+type leaseResult struct {
+	grant  int
+	gen    string
+	member bool
+	pttl   time.Duration
+}
+
+// lease 执行 leaseLua，size 为 0 时只归还和写入
+func (s *RedisLease) lease(ctx context.Context, key string, limit, size int, gen string, unused int, uid string, pending []string) (leaseResult, error) {
+	args := make([]interface{}, 0, 7+len(pending))
+	args = append(args, limit, size, ttlSeconds(s.TTL), gen, uuid.NewString(), unused, uid)
+	for _, u := range pending {
+		args = append(args, u)
+	}
+	ret, err := leaseScript.Run(ctx, s.Rds, []string{key, leaseAllocKey(key)}, args...).Slice()
+	if err != nil {
+		return leaseResult{}, err
+	}
+	return leaseResult{
+		grant:  int(ret[0].(int64)),
+		gen:    ret[1].(string),
+		member: ret[2].(int64) == 1,
+		pttl:   time.Duration(ret[3].(int64)) * time.Millisecond,
+	}, nil
+}
+
+// InsertUser 不检查限量直接写入 Redis，返回当前用户数，包括本实例还没有写入的用户
+func (s *RedisLease) InsertUser(ctx context.Context, key, uid string) (int, error) {
+	ret, err := leaseInsertUserScript.Run(ctx, s.Rds, []string{key, leaseAllocKey(key)}, uid, ttlSeconds(s.TTL)).Int()
+	if err != nil {
+		return 0, err
+	}
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+	s.entry(key).users[uid] = struct{}{}
+	return ret + s.pendingCount(key, uid), nil
+}
+
+// pendingCount 本实例还没有写入的用户数，except 除外，调用方需要持有锁
+func (s *RedisLease) pendingCount(key, except string) int {
+	k, ok := s.store.entries[key]
+	if !ok {
+		return 0
+	}
+	n := 0
+	for _, u := range k.pending {
+		if u != except {
+			n++
+		}
+	}
+	return n
+}
+
+// IsLimited 与 RedisHLL 一致，用户数超过 limit 时返回 true
+func (s *RedisLease) IsLimited(ctx context.Context, key string, limit int) (bool, error) {
+	n, err := s.Count(ctx, key)
+	return n > limit, err
+}
+
+// Count Redis 中的用户数加上本实例还没有写入的用户数
+func (s *RedisLease) Count(ctx context.Context, key string) (int, error) {
+	n, err := s.Rds.SCard(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+	return int(n) + s.pendingCount(key, ""), nil
+}
+
+// KeyTTL 分配计数的过期时间，第一次租用时创建，早于用户写入
+func (s *RedisLease) KeyTTL(ctx context.Context, key string) (time.Duration, error) {
+	return keyTTL(ctx, s.Rds, leaseAllocKey(key))
+}
+
+// Reset 清空用户和分配计数，本实例的租约同时作废
+func (s *RedisLease) Reset(ctx context.Context, key string) error {
+	s.store.mutex.Lock()
+	delete(s.store.entries, key)
+	s.store.mutex.Unlock()
+	return s.Rds.Del(ctx, key, leaseAllocKey(key)).Err()
+}
+
+// Contains 用户是否已经计入，包括本实例还没有写入的用户
+func (s *RedisLease) Contains(ctx context.Context, key, uid string) (bool, error) {
+	s.store.mutex.Lock()
+	k, ok := s.store.entries[key]
+	if ok = ok && !k.allocExpired(time.Now()); ok {
+		_, ok = k.users[uid]
+	}
+	s.store.mutex.Unlock()
+	if ok {
+		return true, nil
+	}
+	return s.Rds.SIsMember(ctx, key, uid).Result()
+}
+
+// ExpireAt key 和分配计数在 tm 过期，分配计数不存在时返回 false
+func (s *RedisLease) ExpireAt(ctx context.Context, key string, tm time.Time) (bool, error) {
+	var cmd *redis.BoolCmd
+	_, err := s.Rds.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ExpireAt(ctx, key, tm)
+		cmd = pipe.ExpireAt(ctx, leaseAllocKey(key), tm)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return cmd.Val(), nil
+}
+
+// release 归还到期(或者 all 为 true 时所有)租约未使用的名额并写入本地计入的用户，
+// 同时删除分配计数已经过期或者长时间没有租用的 key
+func (s *RedisLease) release(ctx context.Context, all bool) error {
+	now := time.Now()
+	idle := now.Add(-leaseIdleRounds * s.LeaseTime)
+	return s.store.release(ctx, func(key string, k *leaseKey) func(context.Context) error {
+		if k.allocExpired(now) {
+			delete(s.store.entries, key)
+			return nil
+		}
+		empty := k.left == 0 && len(k.pending) == 0
+		if empty && k.expireAt.Before(idle) {
+			delete(s.store.entries, key)
+			return nil
+		}
+		if empty || (!all && now.Before(k.expireAt)) {
+			return nil
+		}
+		gen, unused, pending := k.gen, k.left, k.pending
+		k.left, k.pending = 0, nil
+		return func(ctx context.Context) error {
+			return s.giveBack(ctx, key, k, gen, unused, pending)
+		}
+	})
+}
+
+// giveBack 归还未使用的名额并写入本地计入的用户，结束访问 Redis，调用前需要调用 k.begin
+func (s *RedisLease) giveBack(ctx context.Context, key string, k *leaseKey, gen string, unused int, pending []string) error {
+	_, err := s.lease(ctx, key, 0, 0, gen, unused, "", pending)
+	s.store.mutex.Lock()
+	defer s.store.mutex.Unlock()
+	defer k.done()
+	if err != nil && s.store.entries[key] == k {
+		// 请求可能已经执行，归还的名额丢弃，用户放回下一次租用或者归还时重试
+		k.pending = append(pending, k.pending...)
+	}
+	return err
+}
+
+// Close 停止后台归还，归还所有租约未使用的名额并写入本地计入的用户
+func (s *RedisLease) Close() error {
+	return s.store.close()
+}
@@ -0,0 +1,284 @@
+package globaluserlimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"gotest.tools/assert"
+)
+
+const leaseKeyName = "test_lease"
+
+func newTestLease(t *testing.T, size int, leaseTime time.Duration) *RedisLease {
+	l, err := NewRedisLease(newTestRedis(t), time.Minute, size, leaseTime)
+	assert.NilError(t, err)
+	ctx := context.Background()
+	l.Rds.Del(ctx, leaseKeyName, leaseAllocKey(leaseKeyName))
+	t.Cleanup(func() {
+		_ = l.Close()
+		l.Rds.Del(ctx, leaseKeyName, leaseAllocKey(leaseKeyName))
+	})
+	return l
+}
+
+func leaseAllocated(t *testing.T, l *RedisLease) int {
+	n, err := l.Rds.HGet(context.Background(), leaseAllocKey(leaseKeyName), "n").Int()
+	assert.NilError(t, err)
+	return n
+}
+
+func TestRedisLease_Local(t *testing.T) {
+	l := newTestLease(t, 3, time.Minute)
+	ctx := context.Background()
+
+	for _, uid := range []string{"u1", "u2", "u3"} {
+		ret, err := l.TryInsertResult(ctx, leaseKeyName, 10, uid)
+		assert.NilError(t, err)
+		assert.Equal(t, InsertAdmitted, ret)
+	}
+	// 租用一次，用户还在本地
+	assert.Equal(t, 3, leaseAllocated(t, l))
+	n, err := l.Rds.SCard(ctx, leaseKeyName).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(0), n)
+	cnt, err := l.Count(ctx, leaseKeyName)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, cnt)
+
+	// 租约用完，下一次租用时写入用户
+	ret, err := l.TryInsertResult(ctx, leaseKeyName, 10, "u4")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	assert.Equal(t, 6, leaseAllocated(t, l))
+	n, err = l.Rds.SCard(ctx, leaseKeyName).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(3), n)
+
+	// Close 归还未使用的名额
+	assert.NilError(t, l.Close())
+	assert.Equal(t, 4, leaseAllocated(t, l))
+	n, err = l.Rds.SCard(ctx, leaseKeyName).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(4), n)
+}
+
+func TestRedisLease_Expire(t *testing.T) {
+	l1 := newTestLease(t, 5, 30*time.Millisecond)
+	l2, err := NewRedisLease(l1.Rds, time.Minute, 5, time.Minute)
+	assert.NilError(t, err)
+	defer l2.Close()
+	ctx := context.Background()
+
+	ret, err := l1.TryInsertResult(ctx, leaseKeyName, 5, "u1")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	// l1 租用了所有名额
+	ret, err = l2.TryInsertResult(ctx, leaseKeyName, 5, "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+
+	// 租约到期后归还未使用的名额并写入用户
+	deadline := time.Now().Add(time.Second)
+	for leaseAllocated(t, l1) != 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, 1, leaseAllocated(t, l1))
+	ret, err = l2.TryInsertResult(ctx, leaseKeyName, 5, "u1")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAlreadyAdmitted, ret)
+	ret, err = l2.TryInsertResult(ctx, leaseKeyName, 5, "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+}
+
+func TestRedisLease_NeverExceed(t *testing.T) {
+	const limit = 20
+	l1 := newTestLease(t, 3, 5*time.Millisecond)
+	ctx := context.Background()
+	var leases []*RedisLease
+	for i := 0; i < 3; i++ {
+		l, err := NewRedisLease(l1.Rds, time.Minute, 3, 5*time.Millisecond)
+		assert.NilError(t, err)
+		leases = append(leases, l)
+	}
+	leases = append(leases, l1)
+
+	var admitted int64
+	var wg sync.WaitGroup
+	for w := 0; w < 16; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				l := leases[(w+i)%len(leases)]
+				ret, err := l.TryInsertResult(ctx, leaseKeyName, limit, fmt.Sprint("u", w, ":", i))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ret == InsertAdmitted {
+					atomic.AddInt64(&admitted, 1)
+				}
+				if i%5 == 0 {
+					time.Sleep(time.Millisecond)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	for _, l := range leases {
+		assert.NilError(t, l.Close())
+	}
+
+	assert.Assert(t, admitted > 0 && admitted <= limit, "admitted %d", admitted)
+	n, err := l1.Rds.SCard(ctx, leaseKeyName).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, admitted, n)
+	assert.Equal(t, int(admitted), leaseAllocated(t, l1))
+}
+
+func TestRedisLease_Reset(t *testing.T) {
+	l1 := newTestLease(t, 5, time.Minute)
+	l2, err := NewRedisLease(l1.Rds, time.Minute, 5, time.Minute)
+	assert.NilError(t, err)
+	defer l2.Close()
+	ctx := context.Background()
+
+	ret, err := l1.TryInsertResult(ctx, leaseKeyName, 5, "u1")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	assert.NilError(t, l2.Reset(ctx, leaseKeyName))
+	for _, uid := range []string{"u2", "u3"} {
+		ret, err = l2.TryInsertResult(ctx, leaseKeyName, 5, uid)
+		assert.NilError(t, err)
+		assert.Equal(t, InsertAdmitted, ret)
+	}
+
+	// l1 的旧租约作废，归还不修改新的计数，旧的用户也不写入
+	assert.NilError(t, l1.Close())
+	assert.Equal(t, 5, leaseAllocated(t, l1))
+	in, err := l1.Rds.SIsMember(ctx, leaseKeyName, "u1").Result()
+	assert.NilError(t, err)
+	assert.Assert(t, !in)
+}
+
+func TestRedisLease_SingleFlight(t *testing.T) {
+	l := newTestLease(t, 5, time.Minute)
+	ctx := context.Background()
+
+	// 同时到达的请求等待同一次租用，只租用一次
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ret, err := l.TryInsertResult(ctx, leaseKeyName, 100, fmt.Sprint("u", i))
+			assert.Check(t, err)
+			assert.Check(t, ret == InsertAdmitted)
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 5, leaseAllocated(t, l))
+}
+
+func TestRedisLease_Prune(t *testing.T) {
+	l := newTestLease(t, 5, 5*time.Millisecond)
+	ctx := context.Background()
+
+	ret, err := l.TryInsertResult(ctx, leaseKeyName, 5, "u1")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	// 分配计数过期后本地的用户不再计入
+	assert.NilError(t, l.Rds.Del(ctx, leaseKeyName, leaseAllocKey(leaseKeyName)).Err())
+	l.store.mutex.Lock()
+	l.store.entries[leaseKeyName].allocExpireAt = time.Now()
+	l.store.mutex.Unlock()
+	ok, err := l.Contains(ctx, leaseKeyName, "u1")
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	ret, err = l.TryInsertResult(ctx, leaseKeyName, 5, "u1")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	// 租约归还后长时间没有租用的 key 被删除
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		l.store.mutex.Lock()
+		n := len(l.store.entries)
+		l.store.mutex.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	l.store.mutex.Lock()
+	assert.Equal(t, 0, len(l.store.entries))
+	l.store.mutex.Unlock()
+	in, err := l.Rds.SIsMember(ctx, leaseKeyName, "u1").Result()
+	assert.NilError(t, err)
+	assert.Assert(t, in)
+}
+
+// failAfterEval 打开后脚本在 Redis 中执行，但返回错误，模拟执行后超时
+type failAfterEval struct {
+	on int32
+}
+
+func (h *failAfterEval) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *failAfterEval) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	if atomic.LoadInt32(&h.on) == 1 && (cmd.Name() == "evalsha" || cmd.Name() == "eval") {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+func (h *failAfterEval) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h *failAfterEval) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	return nil
+}
+
+func TestRedisLease_ErrorAfterExecute(t *testing.T) {
+	l2 := newTestLease(t, 2, time.Minute)
+	rds := redis.NewClient(l2.Rds.(*redis.Client).Options())
+	defer rds.Close()
+	hook := &failAfterEval{}
+	rds.AddHook(hook)
+	l1, err := NewRedisLease(rds, time.Minute, 2, time.Minute)
+	assert.NilError(t, err)
+	defer l1.Close()
+	ctx := context.Background()
+
+	ret, err := l1.TryInsertResult(ctx, leaseKeyName, 2, "u1")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	// 归还已经执行但返回错误，归还的名额不能再在本地使用
+	atomic.StoreInt32(&hook.on, 1)
+	assert.Assert(t, l1.release(ctx, true) != nil)
+	atomic.StoreInt32(&hook.on, 0)
+	ret, err = l2.TryInsertResult(ctx, leaseKeyName, 2, "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ret, err = l1.TryInsertResult(ctx, leaseKeyName, 2, "u3")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+
+	assert.NilError(t, l1.Close())
+	assert.NilError(t, l2.Close())
+	n, err := l2.Rds.SCard(ctx, leaseKeyName).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(2), n)
+}
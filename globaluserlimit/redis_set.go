@@ -0,0 +1,109 @@
+package globaluserlimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisSet 基于 SET 的精确计数，用户数绝不会超过 limit，适用于奖池等不能超发的场景。
+// 已经计入的用户再次 TryInsert 直接返回 true，不占用新的名额。
+type RedisSet struct {
+	Rds redis.UniversalClient
+	TTL time.Duration
+}
+
+type RedisSetSingleKeyImpl struct {
+	RedisSet
+}
+
+func (r *RedisSetSingleKeyImpl) Key(args ...any) string {
+	return args[0].(string)
+}
+
+func NewRedisSet(rds redis.UniversalClient, ttl time.Duration) (*RedisSet, error) {
+	if ttl < 0 {
+		return nil, ErrBadConfig
+	}
+	return &RedisSet{
+		Rds: rds,
+		TTL: ttl,
+	}, nil
+}
+
+// 返回值 0: 达到限量被拒绝，1: 新计入，2: 之前已经计入
+const setTryInsertLua = `
+if redis.call('SISMEMBER', KEYS[1], ARGV[2]) == 1 then
+	if tonumber(ARGV[3]) > 0 then redis.call('EXPIRE', KEYS[1], ARGV[3]) end
+	return 2
+end
+if redis.call('SCARD', KEYS[1]) >= tonumber(ARGV[1]) then return 0 end
+redis.call('SADD', KEYS[1], ARGV[2])
+if tonumber(ARGV[3]) > 0 then redis.call('EXPIRE', KEYS[1], ARGV[3]) end
+return 1`
+
+const setInsertUserLua = `
+redis.call('SADD', KEYS[1], ARGV[1])
+if tonumber(ARGV[2]) > 0 then redis.call('EXPIRE', KEYS[1], ARGV[2]) end
+return redis.call('SCARD', KEYS[1])`
+
+func (s *RedisSet) TryInsert(ctx context.Context, key string, limit int, uid string) (bool, error) {
+	ret, err := s.TryInsertResult(ctx, key, limit, uid)
+	return ret.Admitted(), err
+}
+
+func (s *RedisSet) TryInsertResult(ctx context.Context, key string, limit int, uid string) (InsertResult, error) {
+	if limit <= 0 {
+		return InsertRejected, nil
+	}
+	ret, err := setTryInsertScript.Run(ctx, s.Rds, []string{key}, limit, uid, ttlSeconds(s.TTL)).Int64()
+	if err != nil {
+		return InsertRejected, err
+	}
+	return InsertResult(ret), nil
+}
+
+// InsertUser 不检查限量直接插入，返回当前用户数
+func (s *RedisSet) InsertUser(ctx context.Context, key, uid string) (int, error) {
+	ret, err := setInsertUserScript.Run(ctx, s.Rds, []string{key}, uid, ttlSeconds(s.TTL)).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return int(ret), nil
+}
+
+// IsLimited 与 RedisHLL 一致，用户数超过 limit 时返回 true
+func (s *RedisSet) IsLimited(ctx context.Context, key string, limit int) (bool, error) {
+	i, err := s.Rds.SCard(ctx, key).Result()
+	return int(i) > limit, err
+}
+
+func (s *RedisSet) Count(ctx context.Context, key string) (int, error) {
+	i, err := s.Rds.SCard(ctx, key).Result()
+	return int(i), err
+}
+
+func (s *RedisSet) KeyTTL(ctx context.Context, key string) (time.Duration, error) {
+	return keyTTL(ctx, s.Rds, key)
+}
+
+func (s *RedisSet) Reset(ctx context.Context, key string) error {
+	return s.Rds.Del(ctx, key).Err()
+}
+
+// Contains 用户是否已经计入
+func (s *RedisSet) Contains(ctx context.Context, key, uid string) (bool, error) {
+	return s.Rds.SIsMember(ctx, key, uid).Result()
+}
+
+// Remove 移除用户并释放名额，返回用户之前是否存在
+func (s *RedisSet) Remove(ctx context.Context, key, uid string) (bool, error) {
+	n, err := s.Rds.SRem(ctx, key, uid).Result()
+	return n > 0, err
+}
+
+// ExpireAt key 在 tm 过期，key 不存在时返回 false
+func (s *RedisSet) ExpireAt(ctx context.Context, key string, tm time.Time) (bool, error) {
+	return s.Rds.ExpireAt(ctx, key, tm).Result()
+}
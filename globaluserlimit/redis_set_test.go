@@ -0,0 +1,91 @@
+package globaluserlimit
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestRedisSet_TryInsert(t *testing.T) {
+	rds := newTestRedis(t)
+	set, err := NewRedisSet(rds, time.Minute)
+	assert.NilError(t, err)
+
+	ulh := UserLimitHelper{
+		LimitElem: &RedisSetSingleKeyImpl{RedisSet: *set},
+	}
+
+	ctx := context.Background()
+	rds.Del(ctx, key)
+	defer rds.Del(ctx, key)
+
+	wg := sync.WaitGroup{}
+	aiOK := atomic.Int32{}
+	for i := 0; i < 100; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := ulh.TryInsert(ctx, 10, "uid"+strconv.Itoa(i), key)
+			if err != nil {
+				t.Errorf("error: %v\n", err)
+			} else if ok {
+				aiOK.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(10), aiOK.Load())
+	n, err := rds.SCard(ctx, key).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(10), n)
+}
+
+func TestRedisSet_Repeat(t *testing.T) {
+	rds := newTestRedis(t)
+	set, err := NewRedisSet(rds, time.Minute)
+	assert.NilError(t, err)
+	ctx := context.Background()
+	rds.Del(ctx, key)
+	defer rds.Del(ctx, key)
+
+	for _, uid := range []string{"u1", "u2"} {
+		ret, err := set.TryInsertResult(ctx, key, 2, uid)
+		assert.NilError(t, err)
+		assert.Equal(t, InsertAdmitted, ret)
+	}
+	// 已经计入的用户在达到限量后仍然通过，不占用名额
+	ret, err := set.TryInsertResult(ctx, key, 2, "u1")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAlreadyAdmitted, ret)
+	ret, err = set.TryInsertResult(ctx, key, 2, "u3")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+
+	in, err := set.Contains(ctx, key, "u1")
+	assert.NilError(t, err)
+	assert.Assert(t, in)
+	in, err = set.Contains(ctx, key, "u3")
+	assert.NilError(t, err)
+	assert.Assert(t, !in)
+
+	// 移除后释放名额
+	removed, err := set.Remove(ctx, key, "u1")
+	assert.NilError(t, err)
+	assert.Assert(t, removed)
+	removed, err = set.Remove(ctx, key, "u1")
+	assert.NilError(t, err)
+	assert.Assert(t, !removed)
+	ret, err = set.TryInsertResult(ctx, key, 2, "u3")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	ttl, err := rds.TTL(ctx, key).Result()
+	assert.NilError(t, err)
+	assert.Assert(t, ttl > 0 && ttl <= time.Minute)
+}
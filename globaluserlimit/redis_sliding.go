@@ -0,0 +1,148 @@
+package globaluserlimit
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+RedisSlidingWindow 滑动窗口精确计数，统计最近 Window 内出现过的用户数，避免固定窗口在边界前后各放过 limit 个用户。
+
+用户保存在 ZSET 中，score 为最后一次出现的时间按 Granularity 向下取整(毫秒)。窗口按 Granularity 滑动:
+当前时间所在的粒度及之前 Window/Granularity - 1 个粒度内出现过的用户计入，更早的用户在下一次写入时清理。
+Granularity 为 0 时精确到毫秒，Granularity 等于 Window 时退化为固定窗口。
+
+已经计入的用户再次 TryInsert 返回 InsertAlreadyAdmitted，并刷新最后出现的时间。
+时间取自客户端，多个实例之间的时钟偏差会体现为窗口边界的偏差。不要和 UserLimitHelper.Window 一起使用。
+*/
+type RedisSlidingWindow struct {
+	Rds         redis.UniversalClient
+	Window      time.Duration
+	Granularity time.Duration
+
+	now func() time.Time
+}
+
+type RedisSlidingWindowSingleKeyImpl struct {
+	RedisSlidingWindow
+}
+
+func (r *RedisSlidingWindowSingleKeyImpl) Key(args ...any) string {
+	return args[0].(string)
+}
+
+func NewRedisSlidingWindow(rds redis.UniversalClient, window, granularity time.Duration) (*RedisSlidingWindow, error) {
+	if window <= 0 || granularity < 0 || granularity > window {
+		return nil, ErrBadConfig
+	}
+	return &RedisSlidingWindow{
+		Rds:         rds,
+		Window:      window,
+		Granularity: granularity,
+	}, nil
+}
+
+// slidingLuaPrelude ARGV[1] 为当前粒度的开始时间，ARGV[2] 为窗口内最早的 score，ARGV[3] 为 key 的过期时间，单位都是毫秒
+const slidingLuaPrelude = `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[2])
+`
+
+// ARGV[4]: limit, ARGV[5]: uid
+// 返回值 0: 达到限量被拒绝，1: 新计入，2: 之前已经计入
+const slidingTryInsertLua = slidingLuaPrelude + `
+if redis.call('ZSCORE', KEYS[1], ARGV[5]) then
+	redis.call('ZADD', KEYS[1], ARGV[1], ARGV[5])
+	redis.call('PEXPIRE', KEYS[1], ARGV[3])
+	return 2
+end
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[4]) then return 0 end
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[5])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return 1`
+
+// ARGV[4]: uid
+const slidingInsertUserLua = slidingLuaPrelude + `
+redis.call('ZADD', KEYS[1], ARGV[1], ARGV[4])
+redis.call('PEXPIRE', KEYS[1], ARGV[3])
+return redis.call('ZCARD', KEYS[1])`
+
+// bounds 返回当前粒度的开始时间、窗口内最早的 score 和 key 的过期时间，单位毫秒
+func (s *RedisSlidingWindow) bounds() (cur, from, ttl int64) {
+	now := time.Now()
+	if s.now != nil {
+		now = s.now()
+	}
+	cur = now.UnixMilli()
+	step := s.Granularity.Milliseconds()
+	if step > 0 {
+		cur -= cur % step
+	}
+	from = cur - s.Window.Milliseconds() + step
+	if step == 0 {
+		from++
+	}
+	ttl = s.Window.Milliseconds() + step
+	return cur, from, ttl
+}
+
+func (s *RedisSlidingWindow) TryInsert(ctx context.Context, key string, limit int, uid string) (bool, error) {
+	ret, err := s.TryInsertResult(ctx, key, limit, uid)
+	return ret.Admitted(), err
+}
+
+func (s *RedisSlidingWindow) TryInsertResult(ctx context.Context, key string, limit int, uid string) (InsertResult, error) {
+	if limit <= 0 {
+		return InsertRejected, nil
+	}
+	cur, from, ttl := s.bounds()
+	ret, err := slidingTryInsertScript.Run(ctx, s.Rds, []string{key}, cur, from, ttl, limit, uid).Int64()
+	if err != nil {
+		return InsertRejected, err
+	}
+	return InsertResult(ret), nil
+}
+
+// InsertUser 不检查限量直接插入，返回窗口内的用户数
+func (s *RedisSlidingWindow) InsertUser(ctx context.Context, key, uid string) (int, error) {
+	cur, from, ttl := s.bounds()
+	ret, err := slidingInsertUserScript.Run(ctx, s.Rds, []string{key}, cur, from, ttl, uid).Int64()
+	if err != nil {
+		return 0, err
+	}
+	return int(ret), nil
+}
+
+// IsLimited 与 RedisHLL 一致，窗口内的用户数超过 limit 时返回 true，只读不清理
+func (s *RedisSlidingWindow) IsLimited(ctx context.Context, key string, limit int) (bool, error) {
+	n, err := s.Count(ctx, key)
+	return n > limit, err
+}
+
+// Count 窗口内的用户数
+func (s *RedisSlidingWindow) Count(ctx context.Context, key string) (int, error) {
+	_, from, _ := s.bounds()
+	n, err := s.Rds.ZCount(ctx, key, strconv.FormatInt(from, 10), "+inf").Result()
+	return int(n), err
+}
+
+// KeyTTL 最后一个用户滑出窗口的时间
+func (s *RedisSlidingWindow) KeyTTL(ctx context.Context, key string) (time.Duration, error) {
+	return keyTTL(ctx, s.Rds, key)
+}
+
+func (s *RedisSlidingWindow) Reset(ctx context.Context, key string) error {
+	return s.Rds.Del(ctx, key).Err()
+}
+
+// Contains 用户是否在窗口内计入
+func (s *RedisSlidingWindow) Contains(ctx context.Context, key, uid string) (bool, error) {
+	_, from, _ := s.bounds()
+	score, err := s.Rds.ZScore(ctx, key, uid).Result()
+	if err == redis.Nil {
+		return false, nil
+	}
+	return err == nil && int64(score) >= from, err
+}
@@ -0,0 +1,62 @@
+package globaluserlimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestRedisSlidingWindow(t *testing.T) {
+	rds := newTestRedis(t)
+	s, err := NewRedisSlidingWindow(rds, time.Minute, 10*time.Second)
+	assert.NilError(t, err)
+	now := time.Now().Truncate(10 * time.Second)
+	s.now = func() time.Time { return now }
+	ulh := UserLimitHelper{LimitElem: &RedisSlidingWindowSingleKeyImpl{RedisSlidingWindow: *s}}
+	ctx := context.Background()
+	rds.Del(ctx, key)
+	defer rds.Del(ctx, key)
+
+	insert := func(uid string, want InsertResult) {
+		t.Helper()
+		ret, err := ulh.TryInsertResult(ctx, 2, uid, key)
+		assert.NilError(t, err)
+		assert.Equal(t, want, ret, uid)
+	}
+
+	insert("u1", InsertAdmitted)
+	now = now.Add(30 * time.Second)
+	insert("u2", InsertAdmitted)
+	now = now.Add(25 * time.Second)
+	insert("u3", InsertRejected)
+
+	// u1 所在的粒度滑出窗口
+	now = now.Add(5 * time.Second)
+	in, err := s.Contains(ctx, key, "u1")
+	assert.NilError(t, err)
+	assert.Assert(t, !in)
+	insert("u3", InsertAdmitted)
+	insert("u2", InsertAlreadyAdmitted)
+	insert("u1", InsertRejected)
+
+	// u2 刷新了最后出现的时间，u3 之后滑出窗口
+	now = now.Add(50 * time.Second)
+	insert("u2", InsertAlreadyAdmitted)
+	insert("u1", InsertRejected)
+	now = now.Add(10 * time.Second)
+	insert("u1", InsertAdmitted)
+	limited, err := ulh.CheckUserLimit(ctx, 1, key)
+	assert.NilError(t, err)
+	assert.Assert(t, limited)
+}
+
+func TestNewRedisSlidingWindow(t *testing.T) {
+	_, err := NewRedisSlidingWindow(nil, 0, 0)
+	assert.Equal(t, ErrBadConfig, err)
+	_, err = NewRedisSlidingWindow(nil, time.Second, time.Minute)
+	assert.Equal(t, ErrBadConfig, err)
+	_, err = NewRedisSlidingWindow(nil, time.Minute, 0)
+	assert.NilError(t, err)
+}
@@ -0,0 +1,149 @@
+package globaluserlimit
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+/*
+Reservation 两阶段占用名额: Reserve 先预留名额，下游发放成功后 Commit 确认，失败时 Cancel 释放。
+超过 ExpireAt 仍未确认的预留会被自动回收，之后 Commit 返回 false。
+
+字段全部导出，可以序列化后跨进程传递，Commit/Cancel 只依赖这些字段。
+*/
+type Reservation struct {
+	Key      string
+	UID      string
+	ID       string
+	ExpireAt time.Time
+}
+
+// Reserver 支持两阶段占用名额的 LimitElem，需要精确计数，目前由 RedisHash 实现
+type Reserver interface {
+	// Reserve 预留一个名额，ttl 内未确认自动回收。
+	// 用户已经确认计入时返回 (nil, InsertAlreadyAdmitted)，已经有未过期的预留时返回该预留和 InsertAlreadyAdmitted。
+	Reserve(ctx context.Context, key string, limit int, uid string, ttl time.Duration) (*Reservation, InsertResult, error)
+
+	// Commit 确认预留，预留已经过期、取消或不存在时返回 false
+	Commit(ctx context.Context, r *Reservation) (bool, error)
+
+	// Cancel 取消预留并释放名额，预留已经过期、确认或不存在时返回 false
+	Cancel(ctx context.Context, r *Reservation) (bool, error)
+}
+
+var _ Reserver = &RedisHash{}
+
+/*
+hashLuaPrelude RedisHash 脚本的公共部分。
+KEYS[1] 是用户 hash，已确认的用户值为计入时间戳，预留中的用户值为 "r:<预留ID>"；
+KEYS[2] 是预留过期时间的 zset，member 为 uid，score 为过期时间(毫秒)。
+reclaim 和 expire 默认操作 KEYS[1]、KEYS[2]，多 key 的脚本可以指定 h、z。
+每个写脚本先回收过期的预留，单次最多回收 100 个，避免脚本执行时间过长。
+*/
+const hashLuaPrelude = `
+local function reclaim(now, h, z)
+	h, z = h or KEYS[1], z or KEYS[2]
+	local expired = redis.call('ZRANGEBYSCORE', z, '-inf', now, 'LIMIT', 0, 100)
+	for _, uid in ipairs(expired) do
+		local v = redis.call('HGET', h, uid)
+		if v and string.sub(v, 1, 2) == 'r:' then redis.call('HDEL', h, uid) end
+		redis.call('ZREM', z, uid)
+	end
+end
+local function expire(ttl, h, z)
+	h, z = h or KEYS[1], z or KEYS[2]
+	if tonumber(ttl) > 0 then
+		redis.call('EXPIRE', h, ttl)
+		redis.call('EXPIRE', z, ttl)
+	end
+end
+`
+
+// ARGV: limit, uid, 预留ID, 预留过期时间(毫秒), ttl, 当前时间(毫秒)
+// 返回 {0} 拒绝，{1} 预留成功，{2} 已经确认计入，{2, 预留ID, 过期时间} 已有未过期的预留
+const hashReserveLua = hashLuaPrelude + `
+reclaim(ARGV[6])
+local v = redis.call('HGET', KEYS[1], ARGV[2])
+if v then
+	if string.sub(v, 1, 2) == 'r:' then
+		return {2, string.sub(v, 3), redis.call('ZSCORE', KEYS[2], ARGV[2])}
+	end
+	expire(ARGV[5])
+	return {2}
+end
+if redis.call('HLEN', KEYS[1]) >= tonumber(ARGV[1]) then return {0} end
+redis.call('HSET', KEYS[1], ARGV[2], 'r:' .. ARGV[3])
+redis.call('ZADD', KEYS[2], ARGV[4], ARGV[2])
+expire(ARGV[5])
+return {1}`
+
+// ARGV: uid, 预留ID, 计入时间戳(秒), ttl, 当前时间(毫秒)
+const hashCommitLua = hashLuaPrelude + `
+reclaim(ARGV[5])
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= 'r:' .. ARGV[2] then return 0 end
+redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+redis.call('ZREM', KEYS[2], ARGV[1])
+expire(ARGV[4])
+return 1`
+
+// ARGV: uid, 预留ID
+const hashCancelLua = `
+if redis.call('HGET', KEYS[1], ARGV[1]) ~= 'r:' .. ARGV[2] then return 0 end
+redis.call('HDEL', KEYS[1], ARGV[1])
+redis.call('ZREM', KEYS[2], ARGV[1])
+return 1`
+
+// reservationKey 预留过期时间 zset 的 key，与用户 hash 位于同一个 slot
+func reservationKey(key string) string {
+	return companionKey(key, ":resv")
+}
+
+func (s *RedisHash) Reserve(ctx context.Context, key string, limit int, uid string, ttl time.Duration) (*Reservation, InsertResult, error) {
+	if limit <= 0 {
+		return nil, InsertRejected, nil
+	}
+	if ttl <= 0 {
+		return nil, InsertRejected, ErrBadConfig
+	}
+
+	now := time.Now()
+	r := &Reservation{
+		Key:      key,
+		UID:      uid,
+		ID:       uuid.NewString(),
+		ExpireAt: now.Add(ttl),
+	}
+	ret, err := hashReserveScript.Run(ctx, s.Rds, []string{key, reservationKey(key)},
+		limit, uid, r.ID, r.ExpireAt.UnixMilli(), ttlSeconds(s.TTL), now.UnixMilli()).Slice()
+	if err != nil {
+		return nil, InsertRejected, err
+	}
+
+	switch InsertResult(ret[0].(int64)) {
+	case InsertAdmitted:
+		return r, InsertAdmitted, nil
+	case InsertAlreadyAdmitted:
+		if len(ret) < 3 {
+			return nil, InsertAlreadyAdmitted, nil
+		}
+		r.ID = ret[1].(string)
+		expireAt, _ := strconv.ParseInt(ret[2].(string), 10, 64)
+		r.ExpireAt = time.UnixMilli(expireAt)
+		return r, InsertAlreadyAdmitted, nil
+	}
+	return nil, InsertRejected, nil
+}
+
+func (s *RedisHash) Commit(ctx context.Context, r *Reservation) (bool, error) {
+	ret, err := hashCommitScript.Run(ctx, s.Rds, []string{r.Key, reservationKey(r.Key)},
+		r.UID, r.ID, time.Now().Unix(), ttlSeconds(s.TTL), time.Now().UnixMilli()).Int64()
+	return ret == 1, err
+}
+
+func (s *RedisHash) Cancel(ctx context.Context, r *Reservation) (bool, error) {
+	ret, err := hashCancelScript.Run(ctx, s.Rds, []string{r.Key, reservationKey(r.Key)}, r.UID, r.ID).Int64()
+	return ret == 1, err
+}
@@ -0,0 +1,113 @@
+package globaluserlimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func newTestReservationHelper(t *testing.T) (*UserLimitHelper, func()) {
+	rds := newTestRedis(t)
+	hash, err := NewRedisHash(rds, time.Minute, 0, 0)
+	assert.NilError(t, err)
+	ctx := context.Background()
+	rds.Del(ctx, key, reservationKey(key))
+	return &UserLimitHelper{
+		LimitElem:      &RedisHashSingleKeyImpl{RedisHash: *hash},
+		LimitCacheTime: time.Minute,
+	}, func() {
+		rds.Del(ctx, key, reservationKey(key))
+	}
+}
+
+func TestUserLimitHelper_Reserve(t *testing.T) {
+	ulh, clean := newTestReservationHelper(t)
+	defer clean()
+	ctx := context.Background()
+
+	r1, ret, err := ulh.Reserve(ctx, 2, "u1", time.Minute, key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	assert.Equal(t, key, r1.Key)
+	assert.Equal(t, "u1", r1.UID)
+
+	// 重复预留返回已有的预留
+	again, ret, err := ulh.Reserve(ctx, 2, "u1", time.Minute, key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAlreadyAdmitted, ret)
+	assert.Equal(t, r1.ID, again.ID)
+	assert.Equal(t, r1.ExpireAt.UnixMilli(), again.ExpireAt.UnixMilli())
+
+	r2, ret, err := ulh.Reserve(ctx, 2, "u2", time.Minute, key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	// 预留占用名额
+	r3, ret, err := ulh.Reserve(ctx, 2, "u3", time.Minute, key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+	assert.Assert(t, r3 == nil)
+	ret, err = ulh.TryInsertResult(ctx, 2, "u3", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+
+	// 确认后名额保留，不能再确认或取消
+	ok, err := ulh.Commit(ctx, r1)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	ok, err = ulh.Commit(ctx, r1)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	ok, err = ulh.Cancel(ctx, r1)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	again, ret, err = ulh.Reserve(ctx, 2, "u1", time.Minute, key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAlreadyAdmitted, ret)
+	assert.Assert(t, again == nil)
+
+	// 取消后名额立即可用，取消的预留不能再确认
+	ok, err = ulh.Cancel(ctx, r2)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	ok, err = ulh.Commit(ctx, r2)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	assert.Assert(t, !ulh.checkLimitedCache(key, 2))
+	r3, ret, err = ulh.Reserve(ctx, 2, "u3", time.Minute, key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	assert.Equal(t, "u3", r3.UID)
+}
+
+func TestUserLimitHelper_ReserveExpire(t *testing.T) {
+	ulh, clean := newTestReservationHelper(t)
+	defer clean()
+	ctx := context.Background()
+
+	r1, ret, err := ulh.Reserve(ctx, 1, "u1", 50*time.Millisecond, key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ret, err = ulh.LimitElem.TryInsertResult(ctx, key, 1, "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+
+	// 过期的预留在下一次写入时回收，之后不能再确认
+	time.Sleep(100 * time.Millisecond)
+	ret, err = ulh.LimitElem.TryInsertResult(ctx, key, 1, "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ok, err := ulh.Commit(ctx, r1)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+}
+
+func TestUserLimitHelper_ReserveNotSupported(t *testing.T) {
+	hll, err := NewRedisHLL(newTestRedis(t), time.Minute, 0, 0)
+	assert.NilError(t, err)
+	ulh := UserLimitHelper{LimitElem: &RedisHLLSingleKeyImpl{RedisHLL: *hll}}
+	_, _, err = ulh.Reserve(context.Background(), 1, "u1", time.Minute, key)
+	assert.Equal(t, ErrNotSupported, err)
+}
@@ -0,0 +1,72 @@
+package globaluserlimit
+
+import (
+	"context"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// 所有 Lua 脚本都在这里注册，执行时先 EVALSHA，Redis 中没有缓存(NOSCRIPT)时回退到 EVAL
+var (
+	hllTryInsertScript      = redis.NewScript(hllTryInsertLua)
+	hllInsertUserScript     = redis.NewScript(hllInsertUserLua)
+	hllTryInsertAllScript   = redis.NewScript(hllTryInsertAllLua)
+	hashTryInsertScript     = redis.NewScript(hashTryInsertLua)
+	hashInsertUserScript    = redis.NewScript(hashInsertUserLua)
+	hashTryInsertAllScript  = redis.NewScript(hashTryInsertAllLua)
+	hashReserveScript       = redis.NewScript(hashReserveLua)
+	hashCommitScript        = redis.NewScript(hashCommitLua)
+	hashCancelScript        = redis.NewScript(hashCancelLua)
+	setTryInsertScript      = redis.NewScript(setTryInsertLua)
+	setInsertUserScript     = redis.NewScript(setInsertUserLua)
+	setTryInsertAllScript   = redis.NewScript(setTryInsertAllLua)
+	slidingTryInsertScript  = redis.NewScript(slidingTryInsertLua)
+	slidingInsertUserScript = redis.NewScript(slidingInsertUserLua)
+	frequencyTryIncrScript  = redis.NewScript(frequencyTryIncrLua)
+	tokenBucketScript       = redis.NewScript(tokenBucketLua)
+	gcraScript              = redis.NewScript(gcraLua)
+	stockInitScript         = redis.NewScript(stockInitLua)
+	stockTakeScript         = redis.NewScript(stockTakeLua)
+	stockReturnScript       = redis.NewScript(stockReturnLua)
+	stockRecordScript       = redis.NewScript(stockRecordLua)
+	leaseScript             = redis.NewScript(leaseLua)
+	leaseInsertUserScript   = redis.NewScript(leaseInsertUserLua)
+)
+
+var scripts = []*redis.Script{
+	hllTryInsertScript,
+	hllInsertUserScript,
+	hllTryInsertAllScript,
+	hashTryInsertScript,
+	hashInsertUserScript,
+	hashTryInsertAllScript,
+	hashReserveScript,
+	hashCommitScript,
+	hashCancelScript,
+	setTryInsertScript,
+	setInsertUserScript,
+	setTryInsertAllScript,
+	slidingTryInsertScript,
+	slidingInsertUserScript,
+	frequencyTryIncrScript,
+	tokenBucketScript,
+	gcraScript,
+	stockInitScript,
+	stockTakeScript,
+	stockReturnScript,
+	stockRecordScript,
+	leaseScript,
+	leaseInsertUserScript,
+}
+
+// Preload 把所有脚本加载到 Redis 的脚本缓存，可以在启动时调用，之后的请求只发送 SHA1。
+// 不调用也可以正常工作，每个脚本第一次执行时会多一次 NOSCRIPT 的往返。
+// ClusterClient 会把脚本加载到所有的 master。
+func Preload(ctx context.Context, rds redis.UniversalClient) error {
+	for _, s := range scripts {
+		if err := s.Load(ctx, rds).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
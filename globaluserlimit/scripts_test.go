@@ -0,0 +1,72 @@
+package globaluserlimit
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestPreload(t *testing.T) {
+	rds := newTestRedis(t)
+	ctx := context.Background()
+	assert.NilError(t, rds.ScriptFlush(ctx).Err())
+
+	assert.NilError(t, Preload(ctx, rds))
+	hashes := make([]string, 0, len(scripts))
+	for _, s := range scripts {
+		hashes = append(hashes, s.Hash())
+	}
+	exists, err := rds.ScriptExists(ctx, hashes...).Result()
+	assert.NilError(t, err)
+	for i, ok := range exists {
+		assert.Assert(t, ok, "script %d is not loaded", i)
+	}
+}
+
+// TestScriptFallback 脚本缓存被清空后回退到 EVAL
+func TestScriptFallback(t *testing.T) {
+	rds := newTestRedis(t)
+	ctx := context.Background()
+	rds.Del(ctx, key)
+	defer rds.Del(ctx, key)
+	assert.NilError(t, rds.ScriptFlush(ctx).Err())
+
+	set, err := NewRedisSet(rds, time.Minute)
+	assert.NilError(t, err)
+	ret, err := set.TryInsertResult(ctx, key, 1, "u1")
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+}
+
+/*
+BenchmarkHLLTryInsert 对比每次发送脚本全文(EVAL)和只发送 SHA1(EVALSHA)，
+script-bytes/op 为每次请求中脚本部分的字节数，例如:
+
+	go test -run XXX -bench HLLTryInsert -benchmem ./globaluserlimit/
+*/
+func BenchmarkHLLTryInsert(b *testing.B) {
+	rds := newTestRedis(b)
+	ctx := context.Background()
+	keys := []string{key, companionKey(key, ":probe")}
+	rds.Del(ctx, key)
+	defer rds.Del(ctx, key)
+	assert.NilError(b, Preload(ctx, rds))
+
+	b.Run("Eval", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := rds.Eval(ctx, hllTryInsertLua, keys, 1000, strconv.Itoa(i%2000), 60).Err()
+			assert.NilError(b, err)
+		}
+		b.ReportMetric(float64(len(hllTryInsertLua)), "script-bytes/op")
+	})
+	b.Run("EvalSha", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			err := hllTryInsertScript.Run(ctx, rds, keys, 1000, strconv.Itoa(i%2000), 60).Err()
+			assert.NilError(b, err)
+		}
+		b.ReportMetric(float64(len(hllTryInsertScript.Hash())), "script-bytes/op")
+	})
+}
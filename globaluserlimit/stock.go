@@ -0,0 +1,490 @@
+package globaluserlimit
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+var ErrStockNotInit = errors.New("stock not initialized")
+
+// stockMaxLocalUsers 开启预分配时每个库存在本地保留的用户数上限
+const stockMaxLocalUsers = 100000
+
+/*
+RedisStock 库存计数: 一共 total 份，每个用户只能领取一次，一次领取 n 份，剩余数量不会小于 0。
+
+库存 key 保存剩余数量，辅助 key(见 companionKey) 为 hash，保存已经领取的用户和份数，检查和扣减在一个 Lua 脚本中完成。
+TTL 在 Init 时设置，用户 hash 跟随库存 key 过期。每次 Init 成功或者 Reset 时生成新的 gen，同样保存在辅助 key 中。
+
+开启本地预分配后(NewRedisStock 的 batch 和 dur 都非0)，本地份数不足时一次从 Redis 多取 batch 份，之后在本地发放，
+同一个库存同时只有一个请求访问 Redis，其他请求等待它完成。本地发放的用户在下一次访问 Redis 时写入，
+预分配的有效期为 dur 秒(不超过库存的过期时间)，到期后后台归还剩余并写入用户。精度上的取舍:
+  - 按用户去重在本实例内是精确的，跨实例只能看到已经写入 Redis 的用户，同一个用户在写入前到其他实例领取可能重复领取，
+    库存仍然不会超发；
+  - Redis 和本实例都不足时直接拒绝，即使其他实例还有预分配的剩余；
+  - Remaining 是 Redis 中的剩余加上本实例预分配的剩余，不包括其他实例预分配的剩余，偏小；
+  - 其他实例 Reset 或者库存过期后重新 Init 时，本实例旧的预分配最多还会发放 dur 秒，之后按 gen 丢弃，
+    本实例的 Init 和 Reset 立即丢弃本地的预分配；
+  - 一个库存在本实例领取的用户达到 stockMaxLocalUsers 后不再预分配，之后每次领取都访问 Redis；
+  - 正常退出需要调用 Close，写入用户并归还预分配的剩余，进程异常退出时预分配的剩余不会归还，只会少发不会超发。
+*/
+type RedisStock struct {
+	Rds redis.UniversalClient
+
+	batchSize int
+	dur       time.Duration
+	maxUsers  int
+	pool      *localAlloc[*stockWindow] // 本实例在每个库存上的预分配
+}
+
+// stockWindow 本实例在一个库存上预分配的份数和领取的用户
+type stockWindow struct {
+	gen           string         // 预分配所属库存的 gen
+	avail         int            // 预分配未发放的份数
+	expireAt      time.Time      // 预分配的有效期
+	stockExpireAt time.Time      // 库存的过期时间，零值为不过期
+	users         map[string]int // 本实例领取的用户和份数，不超过 maxUsers 个
+	pending       map[string]int // 本地发放还没有写入 Redis 的用户
+	direct        bool           // 用户数达到上限，不再预分配
+	allocFlight
+}
+
+// NewRedisStock batch 和 dur(秒) 都非0时开启本地预分配，开启后退出前需要调用 Close
+func NewRedisStock(rds redis.UniversalClient, batch, dur int) (*RedisStock, error) {
+	if batch < 0 || dur < 0 {
+		return nil, ErrBadConfig
+	}
+	s := &RedisStock{Rds: rds}
+	if batch > 0 && dur > 0 {
+		s.batchSize = batch
+		s.dur = time.Duration(dur) * time.Second
+		s.maxUsers = stockMaxLocalUsers
+		s.pool = newLocalAlloc[*stockWindow](s.release)
+		s.pool.start(s.dur)
+	}
+	return s, nil
+}
+
+func stockUsersKey(key string) string {
+	return companionKey(key, ":users")
+}
+
+func stockGenKey(key string) string {
+	return companionKey(key, ":gen")
+}
+
+func stockKeys(key string) []string {
+	return []string{key, stockUsersKey(key), stockGenKey(key)}
+}
+
+// ARGV: 总数, TTL(秒), 是否覆盖, 新的 gen，不覆盖时库存已经存在则返回 0
+const stockInitLua = `
+if tonumber(ARGV[3]) == 1 then
+	redis.call('DEL', KEYS[2])
+	redis.call('SET', KEYS[1], ARGV[1])
+elseif not redis.call('SET', KEYS[1], ARGV[1], 'NX') then
+	return 0
+end
+redis.call('SET', KEYS[3], ARGV[4])
+if tonumber(ARGV[2]) > 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[2])
+	redis.call('EXPIRE', KEYS[3], ARGV[2])
+end
+return 1`
+
+// Init 设置库存总数，库存已经存在时不修改并返回 false，多个实例启动时都可以调用。ttl 为 0 时不过期
+func (s *RedisStock) Init(ctx context.Context, key string, total int, ttl time.Duration) (bool, error) {
+	if total < 0 {
+		return false, ErrBadConfig
+	}
+	ret, err := stockInitScript.Run(ctx, s.Rds, stockKeys(key), total, ttlSeconds(ttl), 0, uuid.NewString()).Int()
+	if ret == 1 {
+		s.drop(key)
+	}
+	return ret == 1, err
+}
+
+// Reset 重新设置库存总数并清空已经领取的用户，同时丢弃本实例预分配的剩余
+func (s *RedisStock) Reset(ctx context.Context, key string, total int, ttl time.Duration) error {
+	if total < 0 {
+		return ErrBadConfig
+	}
+	err := stockInitScript.Run(ctx, s.Rds, stockKeys(key), total, ttlSeconds(ttl), 1, uuid.NewString()).Err()
+	s.drop(key)
+	return err
+}
+
+// drop 丢弃本实例在 key 上的预分配，正在访问 Redis 的请求返回后不再使用它的结果
+func (s *RedisStock) drop(key string) {
+	if s.pool == nil {
+		return
+	}
+	s.pool.mutex.Lock()
+	delete(s.pool.entries, key)
+	s.pool.mutex.Unlock()
+}
+
+/*
+stockTakeLua gen 相同时先归还预分配的剩余并写入本地发放的用户，再领取。
+ARGV: uid, 用户领取的份数, 额外预分配的份数, 本地的 gen, 归还的份数, uid1, n1, uid2, n2, ...
+返回 {结果, 实际预分配的份数, gen, 库存的 PTTL, 用户领取的份数}，
+结果 -1: 库存不存在，0: 库存不足，1: 领取成功，2: 之前已经领取
+*/
+const stockTakeLua = `
+local r = tonumber(redis.call('GET', KEYS[1]))
+if not r then return {-1, 0, '', 0, 0} end
+local gen = redis.call('GET', KEYS[3]) or ''
+if gen == ARGV[4] then
+	if tonumber(ARGV[5]) > 0 then r = redis.call('INCRBY', KEYS[1], ARGV[5]) end
+	for i = 6, #ARGV, 2 do redis.call('HSETNX', KEYS[2], ARGV[i], ARGV[i + 1]) end
+end
+local n = tonumber(ARGV[2])
+local code, extra = 1, 0
+local taken = tonumber(redis.call('HGET', KEYS[2], ARGV[1]))
+if taken then
+	code, n = 2, taken
+elseif r < n then
+	code = 0
+else
+	extra = math.min(tonumber(ARGV[3]), r - n)
+	redis.call('DECRBY', KEYS[1], n + extra)
+	redis.call('HSET', KEYS[2], ARGV[1], n)
+end
+local t = redis.call('PTTL', KEYS[1])
+if t > 0 then redis.call('PEXPIRE', KEYS[2], t) end
+return {code, extra, gen, t, n}`
+
+// stockTake stockTakeLua 的结果
+type stockTake struct {
+	ret   InsertResult
+	extra int
+	gen   string
+	pttl  time.Duration
+	taken int
+}
+
+// TryTake 用户领取 n 份，同一个用户只能领取一次，重复领取返回 InsertAlreadyAdmitted，库存不存在时返回 ErrStockNotInit
+func (s *RedisStock) TryTake(ctx context.Context, key, uid string, n int) (InsertResult, error) {
+	if n <= 0 {
+		return InsertRejected, ErrBadConfig
+	}
+	if s.pool == nil {
+		res, err := s.take(ctx, key, uid, n, 0, "", 0, nil)
+		return res.ret, err
+	}
+
+	p := s.pool
+	p.mutex.Lock()
+	var w *stockWindow
+	for {
+		w = s.window(key)
+		if _, ok := w.users[uid]; ok {
+			p.mutex.Unlock()
+			return InsertAlreadyAdmitted, nil
+		}
+		if w.direct {
+			p.mutex.Unlock()
+			return s.takeDirect(ctx, key, w, uid, n)
+		}
+		if w.avail >= n && len(w.users) < s.maxUsers && time.Now().Before(w.expireAt) {
+			w.avail -= n
+			w.users[uid] = n
+			w.pending[uid] = n
+			p.mutex.Unlock()
+			return InsertAdmitted, nil
+		}
+		if !w.busy() {
+			break
+		}
+		// 其他请求正在访问 Redis，等待它取回新的预分配
+		if err := p.wait(ctx, w); err != nil {
+			p.mutex.Unlock()
+			return InsertRejected, err
+		}
+	}
+
+	// 本地不足或者到期，归还剩余、写入本地发放的用户和新的领取在一次请求中完成
+	w.direct = len(w.users) >= s.maxUsers
+	extra := s.batchSize
+	if w.direct {
+		extra = 0
+	}
+	gen, credit, pending := w.gen, w.avail, w.pending
+	w.avail, w.pending = 0, make(map[string]int)
+	w.begin()
+	p.mutex.Unlock()
+
+	res, err := s.take(ctx, key, uid, n, extra, gen, credit, pending)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	defer w.done()
+	if p.entries[key] != w {
+		// Init、Reset 丢弃了这个预分配，预分配的份数也丢弃，只会少发
+		return res.ret, err
+	}
+	if errors.Is(err, ErrStockNotInit) {
+		delete(p.entries, key)
+		return InsertRejected, err
+	}
+	if err != nil {
+		// 请求可能已经执行，归还的份数丢弃，用户放回下一次重试
+		w.mergePending(pending)
+		return InsertRejected, err
+	}
+	if res.gen != w.gen {
+		// 库存已经重建，本地发放的用户和领取记录作废
+		w.gen, w.users, w.pending = res.gen, make(map[string]int), make(map[string]int)
+	}
+	s.extend(w, res)
+	if res.ret != InsertRejected {
+		w.users[uid] = res.taken
+	}
+	w.trim()
+	return res.ret, nil
+}
+
+// takeDirect 用户数达到上限后直接在 Redis 中领取
+func (s *RedisStock) takeDirect(ctx context.Context, key string, w *stockWindow, uid string, n int) (InsertResult, error) {
+	res, err := s.take(ctx, key, uid, n, 0, "", 0, nil)
+	if errors.Is(err, ErrStockNotInit) {
+		s.pool.mutex.Lock()
+		if s.pool.entries[key] == w {
+			delete(s.pool.entries, key)
+		}
+		s.pool.mutex.Unlock()
+	}
+	return res.ret, err
+}
+
+// window 调用方需要持有锁，库存已经过期的预分配重新创建
+func (s *RedisStock) window(key string) *stockWindow {
+	w, ok := s.pool.entries[key]
+	if !ok || (!w.busy() && w.stockExpired(time.Now())) {
+		w = &stockWindow{users: make(map[string]int), pending: make(map[string]int)}
+		s.pool.entries[key] = w
+	}
+	return w
+}
+
+// extend 加上新的预分配，有效期为 dur 并且不超过库存的过期时间，调用方需要持有锁
+func (s *RedisStock) extend(w *stockWindow, res stockTake) {
+	now := time.Now()
+	w.avail += res.extra
+	w.expireAt = now.Add(s.dur)
+	w.stockExpireAt = time.Time{}
+	if res.pttl > 0 {
+		w.stockExpireAt = now.Add(res.pttl)
+		if w.stockExpireAt.Before(w.expireAt) {
+			w.expireAt = w.stockExpireAt
+		}
+	}
+}
+
+func (w *stockWindow) stockExpired(now time.Time) bool {
+	return !w.stockExpireAt.IsZero() && !now.Before(w.stockExpireAt)
+}
+
+// mergePending 放回写入失败的用户，调用方需要持有锁
+func (w *stockWindow) mergePending(pending map[string]int) {
+	for u, n := range pending {
+		w.pending[u] = n
+	}
+}
+
+// trim 不再预分配并且用户都已经写入后，去重交给 Redis，调用方需要持有锁
+func (w *stockWindow) trim() {
+	if w.direct && len(w.pending) == 0 {
+		w.users = nil
+	}
+}
+
+// take 执行 stockTakeLua
+func (s *RedisStock) take(ctx context.Context, key, uid string, n, extra int, gen string, credit int, pending map[string]int) (stockTake, error) {
+	args := make([]interface{}, 0, 5+2*len(pending))
+	args = append(args, uid, n, extra, gen, credit)
+	args = appendStockUsers(args, pending)
+	ret, err := stockTakeScript.Run(ctx, s.Rds, stockKeys(key), args...).Slice()
+	if err != nil {
+		return stockTake{}, err
+	}
+	code := ret[0].(int64)
+	if code < 0 {
+		return stockTake{}, ErrStockNotInit
+	}
+	return stockTake{
+		ret:   InsertResult(code),
+		extra: int(ret[1].(int64)),
+		gen:   ret[2].(string),
+		pttl:  time.Duration(ret[3].(int64)) * time.Millisecond,
+		taken: int(ret[4].(int64)),
+	}, nil
+}
+
+func appendStockUsers(args []interface{}, users map[string]int) []interface{} {
+	for u, n := range users {
+		args = append(args, u, n)
+	}
+	return args
+}
+
+// stockReturnLua 返回归还的份数，用户没有领取时返回 0，库存已经不存在时只删除用户
+const stockReturnLua = `
+local n = tonumber(redis.call('HGET', KEYS[2], ARGV[1]))
+if not n then return 0 end
+redis.call('HDEL', KEYS[2], ARGV[1])
+if redis.call('EXISTS', KEYS[1]) == 1 then redis.call('INCRBY', KEYS[1], n) end
+return n`
+
+// Return 用户归还领取的份数，用户可以再次领取，返回归还的份数，用户没有领取时返回 0
+func (s *RedisStock) Return(ctx context.Context, key, uid string) (int, error) {
+	if s.pool != nil {
+		// 本地发放的用户先写入 Redis，归还统一在 Redis 中完成
+		if err := s.flushPending(ctx, key); err != nil {
+			return 0, err
+		}
+	}
+	n, err := stockReturnScript.Run(ctx, s.Rds, []string{key, stockUsersKey(key)}, uid).Int()
+	if err != nil {
+		return 0, err
+	}
+	if s.pool != nil {
+		s.pool.mutex.Lock()
+		if w, ok := s.pool.entries[key]; ok {
+			delete(w.users, uid)
+		}
+		s.pool.mutex.Unlock()
+	}
+	return n, nil
+}
+
+// flushPending 写入 key 上本地发放的用户
+func (s *RedisStock) flushPending(ctx context.Context, key string) error {
+	p := s.pool
+	p.mutex.Lock()
+	for {
+		w, ok := p.entries[key]
+		if !ok || (!w.busy() && len(w.pending) == 0) {
+			p.mutex.Unlock()
+			return nil
+		}
+		if !w.busy() {
+			gen, pending := w.gen, w.pending
+			w.pending = make(map[string]int)
+			w.begin()
+			p.mutex.Unlock()
+			return s.record(ctx, key, w, gen, 0, pending)
+		}
+		if err := p.wait(ctx, w); err != nil {
+			p.mutex.Unlock()
+			return err
+		}
+	}
+}
+
+// Remaining 剩余份数，开启本地预分配时加上本实例预分配的剩余，库存不存在时返回 0
+func (s *RedisStock) Remaining(ctx context.Context, key string) (int, error) {
+	n, err := s.Rds.Get(ctx, key).Int()
+	if err != nil && err != redis.Nil {
+		return 0, err
+	}
+	if s.pool != nil {
+		s.pool.mutex.Lock()
+		if w, ok := s.pool.entries[key]; ok {
+			n += w.avail
+		}
+		s.pool.mutex.Unlock()
+	}
+	return n, nil
+}
+
+// Taken 用户领取的份数，没有领取时返回 0
+func (s *RedisStock) Taken(ctx context.Context, key, uid string) (int, error) {
+	if s.pool != nil {
+		s.pool.mutex.Lock()
+		var n int
+		w, ok := s.pool.entries[key]
+		if ok && !w.stockExpired(time.Now()) {
+			n, ok = w.users[uid]
+		}
+		s.pool.mutex.Unlock()
+		if ok {
+			return n, nil
+		}
+	}
+	n, err := s.Rds.HGet(ctx, stockUsersKey(key), uid).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+/*
+stockRecordLua 归还预分配的剩余并写入本地发放的用户，已经存在的用户不覆盖。库存不存在或者 gen 不同时丢弃并返回 0。
+ARGV: 本地的 gen, 归还的份数, uid1, n1, uid2, n2, ...
+*/
+const stockRecordLua = `
+if redis.call('EXISTS', KEYS[1]) == 0 or (redis.call('GET', KEYS[3]) or '') ~= ARGV[1] then return 0 end
+if tonumber(ARGV[2]) > 0 then redis.call('INCRBY', KEYS[1], ARGV[2]) end
+for i = 3, #ARGV, 2 do redis.call('HSETNX', KEYS[2], ARGV[i], ARGV[i + 1]) end
+local t = redis.call('PTTL', KEYS[1])
+if t > 0 then redis.call('PEXPIRE', KEYS[2], t) end
+return 1`
+
+// record 执行 stockRecordLua 并结束访问 Redis，调用前需要调用 w.begin
+func (s *RedisStock) record(ctx context.Context, key string, w *stockWindow, gen string, credit int, pending map[string]int) error {
+	args := make([]interface{}, 0, 2+2*len(pending))
+	args = append(args, gen, credit)
+	args = appendStockUsers(args, pending)
+	ok, err := stockRecordScript.Run(ctx, s.Rds, stockKeys(key), args...).Bool()
+
+	p := s.pool
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	defer w.done()
+	if p.entries[key] != w {
+		return err
+	}
+	switch {
+	case err != nil:
+		// 请求可能已经执行，归还的份数丢弃，用户放回下一次重试
+		w.mergePending(pending)
+	case !ok:
+		// 库存不存在或者已经重建，本地的领取记录作废
+		delete(p.entries, key)
+	default:
+		w.trim()
+	}
+	return err
+}
+
+// release 归还到期(或者 all 为 true 时所有)预分配的剩余并写入本地发放的用户，同时删除库存已经过期的预分配
+func (s *RedisStock) release(ctx context.Context, all bool) error {
+	now := time.Now()
+	return s.pool.release(ctx, func(key string, w *stockWindow) func(context.Context) error {
+		if w.stockExpired(now) {
+			delete(s.pool.entries, key)
+			return nil
+		}
+		if (w.avail == 0 && len(w.pending) == 0) || (!all && now.Before(w.expireAt)) {
+			return nil
+		}
+		gen, credit, pending := w.gen, w.avail, w.pending
+		w.avail, w.pending = 0, make(map[string]int)
+		return func(ctx context.Context) error {
+			return s.record(ctx, key, w, gen, credit, pending)
+		}
+	})
+}
+
+// Close 停止后台归还，写入本地发放的用户并归还预分配的剩余，未开启预分配时什么也不做
+func (s *RedisStock) Close() error {
+	if s.pool == nil {
+		return nil
+	}
+	return s.pool.close()
+}
@@ -0,0 +1,365 @@
+package globaluserlimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+const stockKey = "test_stock"
+
+func cleanStock(t *testing.T, s *RedisStock) {
+	ctx := context.Background()
+	s.Rds.Del(ctx, stockKeys(stockKey)...)
+	t.Cleanup(func() {
+		s.Rds.Del(ctx, stockKeys(stockKey)...)
+	})
+}
+
+func TestRedisStock(t *testing.T) {
+	s, err := NewRedisStock(newTestRedis(t), 0, 0)
+	assert.NilError(t, err)
+	cleanStock(t, s)
+	ctx := context.Background()
+
+	_, err = s.TryTake(ctx, stockKey, "u1", 1)
+	assert.Equal(t, ErrStockNotInit, err)
+
+	ok, err := s.Init(ctx, stockKey, 3, time.Minute)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	// 已经存在时不修改
+	ok, err = s.Init(ctx, stockKey, 100, time.Minute)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+
+	cases := []struct {
+		uid  string
+		n    int
+		want InsertResult
+	}{
+		{"u1", 1, InsertAdmitted},
+		{"u1", 1, InsertAlreadyAdmitted},
+		{"u2", 3, InsertRejected},
+		{"u2", 2, InsertAdmitted},
+		{"u3", 1, InsertRejected},
+	}
+	for _, c := range cases {
+		ret, err := s.TryTake(ctx, stockKey, c.uid, c.n)
+		assert.NilError(t, err)
+		assert.Equal(t, c.want, ret, "%s %d", c.uid, c.n)
+	}
+	n, err := s.Remaining(ctx, stockKey)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, n)
+	n, err = s.Taken(ctx, stockKey, "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, 2, n)
+
+	// 归还后剩余增加，用户可以再次领取
+	n, err = s.Return(ctx, stockKey, "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = s.Return(ctx, stockKey, "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, 0, n)
+	ret, err := s.TryTake(ctx, stockKey, "u3", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ret, err = s.TryTake(ctx, stockKey, "u2", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	// 用户 hash 跟随库存过期
+	ttl, err := s.Rds.TTL(ctx, stockUsersKey(stockKey)).Result()
+	assert.NilError(t, err)
+	assert.Assert(t, ttl > 0 && ttl <= time.Minute, "ttl %v", ttl)
+
+	assert.NilError(t, s.Reset(ctx, stockKey, 1, 0))
+	ret, err = s.TryTake(ctx, stockKey, "u1", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	_, err = s.TryTake(ctx, stockKey, "u1", 0)
+	assert.Equal(t, ErrBadConfig, err)
+}
+
+// takeConcurrently users 个用户并发领取，返回领取成功的数量
+func takeConcurrently(t *testing.T, stocks []*RedisStock, prefix string, users int) int64 {
+	var taken int64
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ret, err := stocks[i%len(stocks)].TryTake(context.Background(), stockKey, fmt.Sprint(prefix, i), 1)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ret == InsertAdmitted {
+				atomic.AddInt64(&taken, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return taken
+}
+
+func TestRedisStock_NoOversell(t *testing.T) {
+	s, err := NewRedisStock(newTestRedis(t), 0, 0)
+	assert.NilError(t, err)
+	cleanStock(t, s)
+	ctx := context.Background()
+	_, err = s.Init(ctx, stockKey, 10, time.Minute)
+	assert.NilError(t, err)
+
+	assert.Equal(t, int64(10), takeConcurrently(t, []*RedisStock{s}, "u", 100))
+	n, err := s.Remaining(ctx, stockKey)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestRedisStock_Batch(t *testing.T) {
+	rds := newTestRedis(t)
+	s1, err := NewRedisStock(rds, 4, 60)
+	assert.NilError(t, err)
+	s2, err := NewRedisStock(rds, 4, 60)
+	assert.NilError(t, err)
+	cleanStock(t, s1)
+	ctx := context.Background()
+	_, err = s1.Init(ctx, stockKey, 10, time.Minute)
+	assert.NilError(t, err)
+
+	// 第一次领取时预分配 4 份
+	ret, err := s1.TryTake(ctx, stockKey, "u1", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	redisLeft, err := rds.Get(ctx, stockKey).Int()
+	assert.NilError(t, err)
+	assert.Equal(t, 5, redisLeft)
+	n, err := s1.Remaining(ctx, stockKey)
+	assert.NilError(t, err)
+	assert.Equal(t, 9, n)
+
+	// 本地发放不访问 Redis，本实例内去重
+	ret, err = s1.TryTake(ctx, stockKey, "u2", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ret, err = s1.TryTake(ctx, stockKey, "u2", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAlreadyAdmitted, ret)
+	redisLeft, err = rds.Get(ctx, stockKey).Int()
+	assert.NilError(t, err)
+	assert.Equal(t, 5, redisLeft)
+	n, err = s1.Taken(ctx, stockKey, "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, n)
+
+	// 归还先写入本地发放的用户
+	n, err = s1.Return(ctx, stockKey, "u2")
+	assert.NilError(t, err)
+	assert.Equal(t, 1, n)
+	in, err := rds.HExists(ctx, stockUsersKey(stockKey), "u2").Result()
+	assert.NilError(t, err)
+	assert.Assert(t, !in)
+	in, err = rds.HExists(ctx, stockUsersKey(stockKey), "u1").Result()
+	assert.NilError(t, err)
+	assert.Assert(t, in)
+
+	// 已经写入 Redis 的用户在其他实例上也不能重复领取
+	ret, err = s2.TryTake(ctx, stockKey, "u1", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAlreadyAdmitted, ret)
+
+	// 两个实例一共最多发放剩余的 9 份，其他实例还有预分配的剩余时，本实例和 Redis 不足也会拒绝
+	taken := takeConcurrently(t, []*RedisStock{s1, s2}, "c", 50)
+	assert.Assert(t, taken > 0 && taken <= 9, "taken %d", taken)
+
+	// 退出后归还预分配的剩余，领取的和剩余的一共 9 份
+	assert.NilError(t, s1.Close())
+	assert.NilError(t, s2.Close())
+	redisLeft, err = rds.Get(ctx, stockKey).Int()
+	assert.NilError(t, err)
+	assert.Equal(t, 9, redisLeft+int(taken))
+	users, err := rds.HLen(ctx, stockUsersKey(stockKey)).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, 1+taken, users)
+}
+
+func TestRedisStock_BatchClose(t *testing.T) {
+	rds := newTestRedis(t)
+	s, err := NewRedisStock(rds, 5, 60)
+	assert.NilError(t, err)
+	cleanStock(t, s)
+	ctx := context.Background()
+	_, err = s.Init(ctx, stockKey, 10, time.Minute)
+	assert.NilError(t, err)
+
+	ret, err := s.TryTake(ctx, stockKey, "u1", 2)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ret, err = s.TryTake(ctx, stockKey, "u2", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	// 退出时归还预分配的剩余
+	assert.NilError(t, s.Close())
+	n, err := rds.Get(ctx, stockKey).Int()
+	assert.NilError(t, err)
+	assert.Equal(t, 7, n)
+	users, err := rds.HGetAll(ctx, stockUsersKey(stockKey)).Result()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, map[string]string{"u1": "2", "u2": "1"}, users)
+}
+
+func TestRedisStock_BatchReinit(t *testing.T) {
+	rds := newTestRedis(t)
+	s1, err := NewRedisStock(rds, 4, 60)
+	assert.NilError(t, err)
+	defer s1.Close()
+	s2, err := NewRedisStock(rds, 0, 0)
+	assert.NilError(t, err)
+	cleanStock(t, s1)
+	ctx := context.Background()
+	_, err = s1.Init(ctx, stockKey, 10, time.Minute)
+	assert.NilError(t, err)
+	assert.NilError(t, rds.PExpire(ctx, stockKey, 50*time.Millisecond).Err())
+
+	ret, err := s1.TryTake(ctx, stockKey, "u1", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	// 预分配不超过库存的过期时间，过期后重新 Init 的库存不会被旧的预分配超发
+	time.Sleep(60 * time.Millisecond)
+	assert.NilError(t, rds.Del(ctx, stockKeys(stockKey)...).Err())
+	ok, err := s2.Init(ctx, stockKey, 1, time.Minute)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	want := []InsertResult{InsertAdmitted, InsertRejected, InsertRejected}
+	for i, uid := range []string{"u1", "u2", "u3"} {
+		ret, err = s1.TryTake(ctx, stockKey, uid, 1)
+		assert.NilError(t, err)
+		assert.Equal(t, want[i], ret, uid)
+	}
+
+	// 本实例的 Reset 立即丢弃预分配
+	assert.NilError(t, s1.Reset(ctx, stockKey, 5, time.Minute))
+	ret, err = s1.TryTake(ctx, stockKey, "u1", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	assert.NilError(t, s1.Reset(ctx, stockKey, 1, time.Minute))
+	for i, uid := range []string{"u1", "u2", "u3"} {
+		ret, err = s1.TryTake(ctx, stockKey, uid, 1)
+		assert.NilError(t, err)
+		assert.Equal(t, want[i], ret, uid)
+	}
+	n, err := s1.Remaining(ctx, stockKey)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, n)
+}
+
+func TestRedisStock_BatchGen(t *testing.T) {
+	rds := newTestRedis(t)
+	s1, err := NewRedisStock(rds, 4, 60)
+	assert.NilError(t, err)
+	defer s1.Close()
+	s2, err := NewRedisStock(rds, 0, 0)
+	assert.NilError(t, err)
+	cleanStock(t, s1)
+	ctx := context.Background()
+	_, err = s1.Init(ctx, stockKey, 10, time.Minute)
+	assert.NilError(t, err)
+
+	ret, err := s1.TryTake(ctx, stockKey, "u1", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ret, err = s1.TryTake(ctx, stockKey, "u2", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	// 其他实例 Reset 后，旧的预分配到期时不归还，本地发放的用户也不写入
+	assert.NilError(t, s2.Reset(ctx, stockKey, 10, time.Minute))
+	s1.pool.mutex.Lock()
+	s1.pool.entries[stockKey].expireAt = time.Now()
+	s1.pool.mutex.Unlock()
+	ret, err = s1.TryTake(ctx, stockKey, "u3", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	redisLeft, err := rds.Get(ctx, stockKey).Int()
+	assert.NilError(t, err)
+	assert.Equal(t, 5, redisLeft)
+	users, err := rds.HKeys(ctx, stockUsersKey(stockKey)).Result()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, []string{"u3"}, users)
+
+	// 旧库存的领取记录同时作废
+	ret, err = s1.TryTake(ctx, stockKey, "u1", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+}
+
+func TestRedisStock_BatchExpired(t *testing.T) {
+	rds := newTestRedis(t)
+	s, err := NewRedisStock(rds, 4, 60)
+	assert.NilError(t, err)
+	cleanStock(t, s)
+	ctx := context.Background()
+	_, err = s.Init(ctx, stockKey, 10, time.Minute)
+	assert.NilError(t, err)
+
+	ret, err := s.TryTake(ctx, stockKey, "u1", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ret, err = s.TryTake(ctx, stockKey, "u2", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+
+	// 库存已经不存在时丢弃，不会留下没有过期时间的用户 hash
+	assert.NilError(t, rds.Del(ctx, stockKeys(stockKey)...).Err())
+	assert.NilError(t, s.Close())
+	n, err := rds.Exists(ctx, stockKeys(stockKey)...).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(0), n)
+	assert.Equal(t, 0, len(s.pool.entries))
+}
+
+func TestRedisStock_BatchMaxUsers(t *testing.T) {
+	rds := newTestRedis(t)
+	s, err := NewRedisStock(rds, 4, 60)
+	assert.NilError(t, err)
+	defer s.Close()
+	s.maxUsers = 2
+	cleanStock(t, s)
+	ctx := context.Background()
+	_, err = s.Init(ctx, stockKey, 10, time.Minute)
+	assert.NilError(t, err)
+
+	for _, uid := range []string{"u1", "u2", "u3"} {
+		ret, err := s.TryTake(ctx, stockKey, uid, 1)
+		assert.NilError(t, err)
+		assert.Equal(t, InsertAdmitted, ret, uid)
+	}
+	// 达到上限后归还预分配，不再保留本地的用户，去重在 Redis 中完成
+	redisLeft, err := rds.Get(ctx, stockKey).Int()
+	assert.NilError(t, err)
+	assert.Equal(t, 7, redisLeft)
+	assert.Equal(t, 0, len(s.pool.entries[stockKey].users))
+	users, err := rds.HLen(ctx, stockUsersKey(stockKey)).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(3), users)
+	ret, err := s.TryTake(ctx, stockKey, "u2", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAlreadyAdmitted, ret)
+	ret, err = s.TryTake(ctx, stockKey, "u4", 1)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	redisLeft, err = rds.Get(ctx, stockKey).Int()
+	assert.NilError(t, err)
+	assert.Equal(t, 6, redisLeft)
+}
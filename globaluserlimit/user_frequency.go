@@ -0,0 +1,165 @@
+package globaluserlimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// FrequencyRule 次数限制规则，0 表示不限制
+type FrequencyRule struct {
+	MaxUsers   int // 窗口内最多多少个不同用户
+	MaxPerUser int // 窗口内每个用户最多多少次
+}
+
+// FrequencyReason 被拒绝的原因
+type FrequencyReason int
+
+const (
+	FrequencyNone       FrequencyReason = iota // 通过
+	FrequencyMaxUsers                          // 新用户，但不同用户数已经达到 MaxUsers
+	FrequencyMaxPerUser                        // 用户次数已经达到 MaxPerUser
+)
+
+func (r FrequencyReason) String() string {
+	switch r {
+	case FrequencyNone:
+		return "none"
+	case FrequencyMaxUsers:
+		return "max_users"
+	case FrequencyMaxPerUser:
+		return "max_per_user"
+	}
+	return "unknown"
+}
+
+// FrequencyResult TryIncr 的结果
+type FrequencyResult struct {
+	Allowed bool
+	Count   int // 用户在窗口内的次数，通过时包含本次
+	Reason  FrequencyReason
+}
+
+type FrequencyElem interface {
+	// TryIncr 检查规则并给用户计一次，检查和计数是原子的。
+	// expireAt 非零时 key 在 expireAt 过期，否则使用实现自己的 TTL。
+	TryIncr(ctx context.Context, key string, rule FrequencyRule, uid string, expireAt time.Time) (FrequencyResult, error)
+
+	// Count 用户在窗口内的次数
+	Count(ctx context.Context, key, uid string) (int, error)
+
+	// Users 窗口内的不同用户数
+	Users(ctx context.Context, key string) (int, error)
+
+	Key(args ...any) string
+}
+
+// UserFrequencyLimit 每个用户是 hash 的一个 field，值为次数
+type UserFrequencyLimit struct {
+	Rds redis.UniversalClient
+	TTL time.Duration
+}
+
+type UserFrequencyLimitSingleKeyImpl struct {
+	UserFrequencyLimit
+}
+
+func (r *UserFrequencyLimitSingleKeyImpl) Key(args ...any) string {
+	return args[0].(string)
+}
+
+func NewUserFrequencyLimit(rds redis.UniversalClient, ttl time.Duration) (*UserFrequencyLimit, error) {
+	if ttl < 0 {
+		return nil, ErrBadConfig
+	}
+	return &UserFrequencyLimit{
+		Rds: rds,
+		TTL: ttl,
+	}, nil
+}
+
+// ARGV: MaxUsers, MaxPerUser, uid, ttl(秒), 过期时间(毫秒)
+// 返回 {FrequencyReason, 次数}
+const frequencyTryIncrLua = `
+local c = tonumber(redis.call('HGET', KEYS[1], ARGV[3]) or '0')
+if c == 0 and tonumber(ARGV[1]) > 0 and redis.call('HLEN', KEYS[1]) >= tonumber(ARGV[1]) then return {1, 0} end
+if tonumber(ARGV[2]) > 0 and c >= tonumber(ARGV[2]) then return {2, c} end
+c = redis.call('HINCRBY', KEYS[1], ARGV[3], 1)
+if tonumber(ARGV[5]) > 0 then
+	redis.call('PEXPIREAT', KEYS[1], ARGV[5])
+elseif tonumber(ARGV[4]) > 0 then
+	redis.call('EXPIRE', KEYS[1], ARGV[4])
+end
+return {0, c}`
+
+func (s *UserFrequencyLimit) TryIncr(ctx context.Context, key string, rule FrequencyRule, uid string, expireAt time.Time) (FrequencyResult, error) {
+	var at int64
+	if !expireAt.IsZero() {
+		at = expireAt.UnixMilli()
+	}
+	ret, err := frequencyTryIncrScript.Run(ctx, s.Rds, []string{key},
+		rule.MaxUsers, rule.MaxPerUser, uid, ttlSeconds(s.TTL), at).Slice()
+	if err != nil {
+		return FrequencyResult{}, err
+	}
+	reason := FrequencyReason(ret[0].(int64))
+	return FrequencyResult{
+		Allowed: reason == FrequencyNone,
+		Count:   int(ret[1].(int64)),
+		Reason:  reason,
+	}, nil
+}
+
+func (s *UserFrequencyLimit) Count(ctx context.Context, key, uid string) (int, error) {
+	n, err := s.Rds.HGet(ctx, key, uid).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (s *UserFrequencyLimit) Users(ctx context.Context, key string) (int, error) {
+	n, err := s.Rds.HLen(ctx, key).Result()
+	return int(n), err
+}
+
+// UserFrequencyHelper 与 UserLimitHelper 相同的用法，设置 Window 时 key 按窗口划分并在窗口结束时过期
+type UserFrequencyHelper struct {
+	FrequencyElem
+
+	Window Window
+
+	now func() time.Time
+}
+
+// TryIncr 检查规则并给用户计一次
+func (h *UserFrequencyHelper) TryIncr(ctx context.Context, rule FrequencyRule, uid string, args ...any) (FrequencyResult, error) {
+	key, end, err := h.key(args...)
+	if err != nil {
+		return FrequencyResult{}, err
+	}
+	return h.FrequencyElem.TryIncr(ctx, key, rule, uid, end)
+}
+
+// Count 用户在当前窗口内的次数
+func (h *UserFrequencyHelper) Count(ctx context.Context, uid string, args ...any) (int, error) {
+	key, _, err := h.key(args...)
+	if err != nil {
+		return 0, err
+	}
+	return h.FrequencyElem.Count(ctx, key, uid)
+}
+
+// Users 当前窗口内的不同用户数
+func (h *UserFrequencyHelper) Users(ctx context.Context, args ...any) (int, error) {
+	key, _, err := h.key(args...)
+	if err != nil {
+		return 0, err
+	}
+	return h.FrequencyElem.Users(ctx, key)
+}
+
+func (h *UserFrequencyHelper) key(args ...any) (string, time.Time, error) {
+	return h.Window.windowKey(h.FrequencyElem.Key(args...), h.now)
+}
@@ -0,0 +1,91 @@
+package globaluserlimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestUserFrequencyHelper(t *testing.T) {
+	rds := newTestRedis(t)
+	f, err := NewUserFrequencyLimit(rds, time.Minute)
+	assert.NilError(t, err)
+	ufh := UserFrequencyHelper{FrequencyElem: &UserFrequencyLimitSingleKeyImpl{UserFrequencyLimit: *f}}
+	ctx := context.Background()
+	rds.Del(ctx, key)
+	defer rds.Del(ctx, key)
+
+	rule := FrequencyRule{MaxUsers: 2, MaxPerUser: 3}
+	cases := []struct {
+		uid  string
+		want FrequencyResult
+	}{
+		{"u1", FrequencyResult{true, 1, FrequencyNone}},
+		{"u1", FrequencyResult{true, 2, FrequencyNone}},
+		{"u2", FrequencyResult{true, 1, FrequencyNone}},
+		{"u3", FrequencyResult{false, 0, FrequencyMaxUsers}},
+		{"u1", FrequencyResult{true, 3, FrequencyNone}},
+		{"u1", FrequencyResult{false, 3, FrequencyMaxPerUser}},
+		{"u2", FrequencyResult{true, 2, FrequencyNone}},
+	}
+	for i, c := range cases {
+		ret, err := ufh.TryIncr(ctx, rule, c.uid, key)
+		assert.NilError(t, err)
+		assert.Equal(t, c.want, ret, "TryIncr %d %s", i, c.uid)
+	}
+
+	cnt, err := ufh.Count(ctx, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, 3, cnt)
+	cnt, err = ufh.Count(ctx, "u3", key)
+	assert.NilError(t, err)
+	assert.Equal(t, 0, cnt)
+	users, err := ufh.Users(ctx, key)
+	assert.NilError(t, err)
+	assert.Equal(t, 2, users)
+	ttl, err := rds.TTL(ctx, key).Result()
+	assert.NilError(t, err)
+	assert.Assert(t, ttl > 0 && ttl <= time.Minute)
+
+	// 0 表示不限制
+	ret, err := ufh.TryIncr(ctx, FrequencyRule{}, "u3", key)
+	assert.NilError(t, err)
+	assert.Equal(t, FrequencyResult{true, 1, FrequencyNone}, ret)
+}
+
+func TestUserFrequencyHelper_Window(t *testing.T) {
+	rds := newTestRedis(t)
+	f, err := NewUserFrequencyLimit(rds, 0)
+	assert.NilError(t, err)
+	now := time.Now()
+	ufh := UserFrequencyHelper{
+		FrequencyElem: &UserFrequencyLimitSingleKeyImpl{UserFrequencyLimit: *f},
+		Window:        Window{Type: WindowPeriod, Period: time.Hour, PeriodStart: now.Truncate(time.Hour)},
+		now:           func() time.Time { return now },
+	}
+	ctx := context.Background()
+	cur, end, err := ufh.key(key)
+	assert.NilError(t, err)
+	next := key + ufh.Window.suffix(end)
+	rds.Del(ctx, cur, next)
+	defer rds.Del(ctx, cur, next)
+
+	rule := FrequencyRule{MaxPerUser: 1}
+	ret, err := ufh.TryIncr(ctx, rule, "u1", key)
+	assert.NilError(t, err)
+	assert.Assert(t, ret.Allowed)
+	ret, err = ufh.TryIncr(ctx, rule, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, FrequencyMaxPerUser, ret.Reason)
+	ttl, err := rds.PTTL(ctx, cur).Result()
+	assert.NilError(t, err)
+	assert.Assert(t, ttl > 0 && ttl <= time.Hour, "ttl %v", ttl)
+
+	// 下一个窗口重新计数
+	now = end
+	ret, err = ufh.TryIncr(ctx, rule, "u1", key)
+	assert.NilError(t, err)
+	assert.Assert(t, ret.Allowed)
+}
@@ -0,0 +1,111 @@
+package globaluserlimit
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/wlbgo/utils"
+)
+
+// WindowType 限量窗口的类型
+type WindowType int
+
+const (
+	WindowNone    WindowType = iota // 不分窗口，只依赖 LimitElem 的 TTL
+	WindowDaily                     // 自然日
+	WindowWeekly                    // 自然周，从 WeekStart 开始
+	WindowMonthly                   // 自然月
+	WindowPeriod                    // 从 PeriodStart 开始每 Period 一个窗口
+)
+
+/*
+Window 按日历对齐的限量窗口，例如活动时区内每天最多 N 个用户。
+
+UserLimitHelper 设置 Window 后，key 会加上窗口起始时间的后缀，例如 "item:1:d20240401"，
+每个窗口单独计数，key 在窗口结束时通过 EXPIREAT 过期。LimitElem 的 TTL 需要设置为 0，
+否则每次写入的 EXPIRE 会覆盖窗口的过期时间。
+*/
+type Window struct {
+	Type      WindowType
+	Location  *time.Location // 窗口所在时区，默认 time.Local
+	WeekStart int            // WindowWeekly 每周的第一天，1 为周一，7 为周日，默认 1
+
+	// WindowPeriod 使用，PeriodStart 为第一个窗口的开始时间
+	Period      time.Duration
+	PeriodStart time.Time
+}
+
+// ExpireAter 支持在指定时间过期的 LimitElem，key 已经不存在时返回 false
+type ExpireAter interface {
+	ExpireAt(ctx context.Context, key string, tm time.Time) (bool, error)
+}
+
+// Bounds 返回 now 所在窗口的开始和结束时间
+func (w *Window) Bounds(now time.Time) (start, end time.Time, err error) {
+	loc := w.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	now = now.In(loc)
+
+	switch w.Type {
+	case WindowDaily:
+		start = time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 0, 1), nil
+	case WindowWeekly:
+		day := w.WeekStart
+		if day == 0 {
+			day = 1
+		}
+		start, err = utils.GetWeekDayStartTimeIn(now.Unix(), day, loc)
+		if err != nil {
+			return start, end, ErrBadConfig
+		}
+		// GetWeekDayStartTimeIn 返回本周(周一到周日)的第 day 天，可能在 now 之后
+		if start.After(now) {
+			start = start.AddDate(0, 0, -7)
+		}
+		return start, start.AddDate(0, 0, 7), nil
+	case WindowMonthly:
+		start = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0), nil
+	case WindowPeriod:
+		if w.Period <= 0 || w.PeriodStart.IsZero() || now.Before(w.PeriodStart) {
+			return start, end, ErrBadConfig
+		}
+		start = utils.NearlyPeriodStartTime(w.PeriodStart, w.Period, now).In(loc)
+		return start, start.Add(w.Period), nil
+	}
+	return start, end, ErrBadConfig
+}
+
+// windowKey 给 key 加上 now 所在窗口的后缀，并返回窗口的结束时间，WindowNone 时原样返回 key
+func (w *Window) windowKey(key string, now func() time.Time) (string, time.Time, error) {
+	if w.Type == WindowNone {
+		return key, time.Time{}, nil
+	}
+	tm := time.Now()
+	if now != nil {
+		tm = now()
+	}
+	start, end, err := w.Bounds(tm)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return key + w.suffix(start), end, nil
+}
+
+// suffix 窗口 key 的后缀，由窗口开始时间决定
+func (w *Window) suffix(start time.Time) string {
+	switch w.Type {
+	case WindowDaily:
+		return ":d" + start.Format("20060102")
+	case WindowWeekly:
+		return ":w" + start.Format("20060102")
+	case WindowMonthly:
+		return ":m" + start.Format("200601")
+	default:
+		return ":p" + strconv.FormatInt(start.Unix(), 10)
+	}
+}
@@ -0,0 +1,96 @@
+package globaluserlimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+func TestWindow_Bounds(t *testing.T) {
+	cst := time.FixedZone("CST", 8*3600)
+	// 2024-04-03 周三 01:30 CST，UTC 还是 04-02
+	now := time.Date(2024, 4, 3, 1, 30, 0, 0, cst)
+	day := func(m time.Month, d int) time.Time { return time.Date(2024, m, d, 0, 0, 0, 0, cst) }
+
+	cases := []struct {
+		name      string
+		window    Window
+		wantStart time.Time
+		wantEnd   time.Time
+		wantErr   bool
+	}{
+		{"Daily", Window{Type: WindowDaily, Location: cst}, day(4, 3), day(4, 4), false},
+		{"DailyUTC", Window{Type: WindowDaily, Location: time.UTC},
+			time.Date(2024, 4, 2, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 3, 0, 0, 0, 0, time.UTC), false},
+		{"Weekly", Window{Type: WindowWeekly, Location: cst}, day(4, 1), day(4, 8), false},
+		{"WeeklyFromWed", Window{Type: WindowWeekly, Location: cst, WeekStart: 3}, day(4, 3), day(4, 10), false},
+		{"WeeklyFromThu", Window{Type: WindowWeekly, Location: cst, WeekStart: 4}, day(3, 28), day(4, 4), false},
+		{"WeeklyFromSun", Window{Type: WindowWeekly, Location: cst, WeekStart: 7}, day(3, 31), day(4, 7), false},
+		{"WeeklyBadDay", Window{Type: WindowWeekly, Location: cst, WeekStart: 8}, time.Time{}, time.Time{}, true},
+		{"Monthly", Window{Type: WindowMonthly, Location: cst}, day(4, 1), day(5, 1), false},
+		{"Period", Window{Type: WindowPeriod, Location: cst, Period: 12 * time.Hour, PeriodStart: day(4, 1).Add(6 * time.Hour)},
+			day(4, 2).Add(18 * time.Hour), day(4, 3).Add(6 * time.Hour), false},
+		{"PeriodNotStarted", Window{Type: WindowPeriod, Period: time.Hour, PeriodStart: now.Add(time.Hour)}, time.Time{}, time.Time{}, true},
+		{"PeriodZero", Window{Type: WindowPeriod, PeriodStart: now}, time.Time{}, time.Time{}, true},
+		{"None", Window{}, time.Time{}, time.Time{}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			start, end, err := c.window.Bounds(now)
+			if c.wantErr {
+				assert.Equal(t, ErrBadConfig, err)
+				return
+			}
+			assert.NilError(t, err)
+			assert.Assert(t, start.Equal(c.wantStart), "start %v, want %v", start, c.wantStart)
+			assert.Assert(t, end.Equal(c.wantEnd), "end %v, want %v", end, c.wantEnd)
+		})
+	}
+}
+
+func TestUserLimitHelper_Window(t *testing.T) {
+	rds := newTestRedis(t)
+	hash, err := NewRedisHash(rds, 0, 0, 0)
+	assert.NilError(t, err)
+	cst := time.FixedZone("CST", 8*3600)
+	now := time.Now().In(cst)
+	ulh := UserLimitHelper{
+		LimitElem: &RedisHashSingleKeyImpl{RedisHash: *hash},
+		Window:    Window{Type: WindowDaily, Location: cst},
+		now:       func() time.Time { return now },
+	}
+	ctx := context.Background()
+	today := key + ":d" + now.Format("20060102")
+	tomorrow := key + ":d" + now.AddDate(0, 0, 1).Format("20060102")
+	rds.Del(ctx, today, tomorrow)
+	defer rds.Del(ctx, today, tomorrow)
+
+	ret, err := ulh.TryInsertResult(ctx, 1, "u1", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	ret, err = ulh.TryInsertResult(ctx, 1, "u2", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertRejected, ret)
+
+	// 窗口 key 在当天结束时过期
+	n, err := rds.HLen(ctx, today).Result()
+	assert.NilError(t, err)
+	assert.Equal(t, int64(1), n)
+	ttl, err := rds.TTL(ctx, today).Result()
+	assert.NilError(t, err)
+	assert.Assert(t, ttl > 0 && ttl <= 24*time.Hour, "ttl %v", ttl)
+
+	// 第二天重新计数
+	now = now.AddDate(0, 0, 1)
+	ret, err = ulh.TryInsertResult(ctx, 1, "u2", key)
+	assert.NilError(t, err)
+	assert.Equal(t, InsertAdmitted, ret)
+	limited, err := ulh.CheckUserLimit(ctx, 0, key)
+	assert.NilError(t, err)
+	assert.Assert(t, limited)
+	ttl, err = rds.TTL(ctx, tomorrow).Result()
+	assert.NilError(t, err)
+	assert.Assert(t, ttl > 24*time.Hour && ttl <= 48*time.Hour, "ttl %v", ttl)
+}
@@ -0,0 +1,131 @@
+// Package redistest starts local Redis servers for tests.
+package redistest
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const clusterSlots = 16384
+
+// NewCluster starts a Redis Cluster of n masters (no replicas) with the redis-server binary found
+// in $REDIS_SERVER or $PATH, the test is skipped when there is none. The servers are stopped and
+// their files removed when the test finishes.
+func NewCluster(t testing.TB, n int) *redis.ClusterClient {
+	t.Helper()
+	bin := os.Getenv("REDIS_SERVER")
+	if bin == "" {
+		var err error
+		if bin, err = exec.LookPath("redis-server"); err != nil {
+			t.Skip("redis-server is not available")
+		}
+	}
+
+	dir := t.TempDir()
+	addrs := make([]string, n)
+	nodes := make([]*redis.Client, n)
+	for i := 0; i < n; i++ {
+		port := freePort(t)
+		addrs[i] = "127.0.0.1:" + strconv.Itoa(port)
+		startServer(t, bin, dir, port)
+		node := redis.NewClient(&redis.Options{Addr: addrs[i]})
+		nodes[i] = node
+		t.Cleanup(func() { _ = node.Close() })
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	for i, node := range nodes {
+		waitReady(ctx, t, node)
+		slots := make([]int, 0, clusterSlots/n+1)
+		for s := i * clusterSlots / n; s < (i+1)*clusterSlots/n; s++ {
+			slots = append(slots, s)
+		}
+		if err := node.ClusterAddSlots(ctx, slots...).Err(); err != nil {
+			t.Fatalf("cluster addslots on %s: %v", addrs[i], err)
+		}
+	}
+	for i := 1; i < n; i++ {
+		host, port, _ := net.SplitHostPort(addrs[i])
+		if err := nodes[0].ClusterMeet(ctx, host, port).Err(); err != nil {
+			t.Fatalf("cluster meet %s: %v", addrs[i], err)
+		}
+	}
+	for _, node := range nodes {
+		waitClusterOK(ctx, t, node)
+	}
+
+	cc := redis.NewClusterClient(&redis.ClusterOptions{Addrs: addrs})
+	t.Cleanup(func() { _ = cc.Close() })
+	cc.ReloadState(ctx)
+	if err := cc.Ping(ctx).Err(); err != nil {
+		t.Fatalf("cluster ping: %v", err)
+	}
+	return cc
+}
+
+func freePort(t testing.TB) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func startServer(t testing.TB, bin, dir string, port int) {
+	p := strconv.Itoa(port)
+	cmd := exec.Command(bin,
+		"--port", p,
+		"--bind", "127.0.0.1",
+		"--dir", dir,
+		"--cluster-enabled", "yes",
+		"--cluster-config-file", filepath.Join(dir, "nodes-"+p+".conf"),
+		"--save", "",
+		"--appendonly", "no",
+	)
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start redis-server: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+	})
+}
+
+func waitReady(ctx context.Context, t testing.TB, node *redis.Client) {
+	for {
+		if err := node.Ping(ctx).Err(); err == nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("redis-server %s is not ready", node.Options().Addr)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+func waitClusterOK(ctx context.Context, t testing.TB, node *redis.Client) {
+	for {
+		info, err := node.ClusterInfo(ctx).Result()
+		if err == nil && strings.Contains(info, "cluster_state:ok") {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatalf("cluster is not ok on %s: %v", node.Options().Addr, fmt.Sprint(info, err))
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
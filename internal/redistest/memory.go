@@ -0,0 +1,50 @@
+package redistest
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// NewMemory starts an in-process Redis (miniredis) for tests that need a single server but should not
+// depend on one being installed. Keys expire in real time like on a real server. The server is stopped
+// when the test finishes.
+func NewMemory(t testing.TB) *redis.Client {
+	t.Helper()
+	mr := miniredis.NewMiniRedis()
+	if err := mr.Start(); err != nil {
+		t.Fatalf("start miniredis: %v", err)
+	}
+
+	// miniredis only expires keys when told time has passed
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(5 * time.Millisecond)
+		defer ticker.Stop()
+		last := time.Now()
+		for {
+			select {
+			case now := <-ticker.C:
+				mr.FastForward(now.Sub(last))
+				last = now
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	rds := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() {
+		_ = rds.Close()
+		close(stop)
+		wg.Wait()
+		mr.Close()
+	})
+	return rds
+}
@@ -85,3 +85,22 @@ func TestNearlyPeriodStartTime(t *testing.T) {
 	}
 
 }
+
+func TestGetWeekDayStartTimeIn(t *testing.T) {
+	cst := time.FixedZone("CST", 8*3600)
+	// 1711900800 is "Sun Mar 31 16:00:00 UTC 2024", already Monday in CST
+	got, err := GetWeekDayStartTimeIn(1711900800, 1, cst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 4, 1, 0, 0, 0, 0, cst); !got.Equal(want) {
+		t.Errorf("GetWeekDayStartTimeIn() got = %v, want %v", got, want)
+	}
+	got, err = GetWeekDayStartTimeIn(1711900800, 1, time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 3, 25, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Errorf("GetWeekDayStartTimeIn() got = %v, want %v", got, want)
+	}
+}